@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/monadbobo/br/pkg/backup"
+	"github.com/monadbobo/br/pkg/config"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -12,42 +15,73 @@ func NewBackupCmd() *cobra.Command {
 		Short: "backup Nebula Graph Database",
 	}
 
-	backupCmd.AddCommand(newFullBackupCmd())
-	backupCmd.PersistentFlags().StringArrayVar(&cf.MetaAddrs, "meta", nil, "meta server url")
-	backupCmd.MarkPersistentFlagRequired("meta")
-	backupCmd.PersistentFlags().StringArrayVar(&cf.StorageAddrs, "storage", nil, "storage server url")
-	backupCmd.PersistentFlags().StringArrayVar(&cf.SpaceNames, "space", nil, "space name")
-	backupCmd.PersistentFlags().StringVar(&cf.BackendUrl, "backend", "", "backend url")
-	backupCmd.MarkPersistentFlagRequired("backend")
-	backupCmd.PersistentFlags().StringVar(&cf.StorageUser, "storageuser", "", "storage server user")
-	backupCmd.MarkPersistentFlagRequired("storageuser")
-	backupCmd.PersistentFlags().StringVar(&cf.MetaUser, "metauser", "", "meta server user")
-	backupCmd.MarkPersistentFlagRequired("metauser")
+	backupCmd.AddCommand(newFullBackupCmd(), newIncrBackupCmd())
+	addClusterFlags(backupCmd, &cf)
+	backupCmd.PersistentFlags().StringArrayVar(&cf.SpaceNames, "space", nil, "space name, all spaces will be backed up if not set")
+	backupCmd.PersistentFlags().BoolVar(&cf.NoChecksum, "no-checksum", false, "do not record the sha256 of the files, which reads every file once more before the upload; verify then only checks the sizes")
+	backupCmd.PersistentFlags().DurationVar(&cf.ProgressInterval, "progress-interval", 10*time.Second, "interval of printing the progress, 0 to disable it")
+	addMetricsFlags(backupCmd.PersistentFlags(), &cf.Metrics)
+	addHookFlags(backupCmd.PersistentFlags(), &cf.Hooks, backup.Phases)
 
 	return backupCmd
 }
 
+// runBackup runs a full backup, or an incremental one if --base is set.
+func runBackup(cmd *cobra.Command, args []string) error {
+	// nil mean backup all space
+	logger, _ := zap.NewProduction()
+
+	defer logger.Sync() // flushes buffer, if any
+	b, err := backup.NewBackupClient(cf, logger)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	err = b.Open(cmd.Context())
+	if err != nil {
+		return err
+	}
+	err = b.BackupCluster(cmd.Context())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func newFullBackupCmd() *cobra.Command {
 	fullBackupCmd := &cobra.Command{
 		Use:   "full",
 		Short: "full backup Nebula Graph Database",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// nil mean backup all space
-			logger, _ := zap.NewProduction()
-
-			defer logger.Sync() // flushes buffer, if any
-			b := backup.NewBackupClient(cf, logger)
-			err := b.Open(cf.MetaAddrs[0])
-			if err != nil {
-				return err
-			}
-			err = b.BackupCluster()
-			if err != nil {
-				return err
-			}
-			return nil
-		},
+		RunE:  runBackup,
 	}
 
 	return fullBackupCmd
 }
+
+func newIncrBackupCmd() *cobra.Command {
+	incrBackupCmd := &cobra.Command{
+		Use:   "incr",
+		Short: "incremental backup Nebula Graph Database, only the new sst files are uploaded",
+		RunE:  runBackup,
+	}
+
+	incrBackupCmd.Flags().StringVar(&cf.BaseBackup, "base", "", "the backup this incremental backup based on")
+	incrBackupCmd.MarkFlagRequired("base")
+
+	return incrBackupCmd
+}
+
+// addClusterFlags adds the flags of the cluster and the backend used by backup and check.
+func addClusterFlags(cmd *cobra.Command, cf *config.BackupConfig) {
+	cmd.PersistentFlags().StringArrayVar(&cf.MetaAddrs, "meta", nil, "meta server url")
+	cmd.MarkPersistentFlagRequired("meta")
+	cmd.PersistentFlags().StringArrayVar(&cf.StorageAddrs, "storage", nil, "storage server url")
+	cmd.PersistentFlags().StringVar(&cf.BackendUrl, "backend", "", "backend url")
+	cmd.MarkPersistentFlagRequired("backend")
+	cmd.PersistentFlags().StringVar(&cf.StorageUser, "storageuser", "", "storage server user")
+	cmd.MarkPersistentFlagRequired("storageuser")
+	cmd.PersistentFlags().StringVar(&cf.MetaUser, "metauser", "", "meta server user")
+	cmd.MarkPersistentFlagRequired("metauser")
+	addSSHFlags(cmd, &cf.SSH)
+	addMetaClientFlags(cmd.PersistentFlags(), &cf.MetaClient)
+}
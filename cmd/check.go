@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/monadbobo/br/pkg/check"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewCheckCmd() *cobra.Command {
+	checkCmd := &cobra.Command{
+		Use:          "check",
+		Short:        "check the cluster and the hosts are ready for a backup",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			c, err := check.NewCheck(cf, logger)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+
+			failed := check.Print(os.Stdout, c.Run(cmd.Context()))
+			if failed != 0 {
+				return fmt.Errorf("%d checks failed", failed)
+			}
+			return nil
+		},
+	}
+
+	addClusterFlags(checkCmd, &cf)
+	return checkCmd
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monadbobo/br/pkg/prune"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewCleanupCmd() *cobra.Command {
+	var grace string
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "drop the snapshots of the failed backups",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			d, err := prune.ParseDuration(grace)
+			if err != nil {
+				return err
+			}
+			deleteConfig.Grace = d
+
+			p, err := prune.NewPrune(deleteConfig, logger)
+			if err != nil {
+				return err
+			}
+			defer p.Close()
+
+			names, err := p.CleanupSnapshots(cmd.Context())
+			for _, name := range names {
+				if deleteConfig.DryRun {
+					fmt.Printf("would drop snapshot %s\n", name)
+				} else {
+					fmt.Printf("dropped snapshot %s\n", name)
+				}
+			}
+			return err
+		},
+	}
+
+	addDeleteFlags(cleanupCmd)
+	cleanupCmd.Flags().StringVar(&grace, "grace", "1d", "keep the snapshots created within the duration, they may belong to running backups")
+	return cleanupCmd
+}
@@ -1,8 +1,107 @@
 package cmd
 
-import "github.com/monadbobo/br/pkg/config"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
 
 var (
 	cf            config.BackupConfig
 	restoreConfig config.RestoreConfig
+	listConfig    config.ListConfig
+	showConfig    config.ShowConfig
+	deleteConfig  config.DeleteConfig
+	verifyConfig  config.VerifyConfig
 )
+
+// hostJumpsValue is the flag value of host=hop1,hop2, the hops are not split
+// into several hosts like StringToString does.
+type hostJumpsValue map[string][]string
+
+func (v *hostJumpsValue) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("%s must be formatted as host=hop1,hop2", s)
+	}
+	if *v == nil {
+		*v = make(map[string][]string)
+	}
+	(*v)[kv[0]] = strings.Split(kv[1], ",")
+	return nil
+}
+
+func (v *hostJumpsValue) String() string {
+	var pairs []string
+	for host, jumps := range *v {
+		pairs = append(pairs, host+"="+strings.Join(jumps, ","))
+	}
+	sort.Strings(pairs)
+	return "[" + strings.Join(pairs, " ") + "]"
+}
+
+func (v *hostJumpsValue) Type() string {
+	return "stringToStrings"
+}
+
+// hooksValue is the flag value of the hooks, every one is <pre|post>-<phase>[@[user@]host]=<command>.
+type hooksValue []config.Hook
+
+func (v *hooksValue) Set(s string) error {
+	h, err := config.ParseHook(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, h)
+	return nil
+}
+
+func (v *hooksValue) String() string {
+	var hooks []string
+	for _, h := range *v {
+		hooks = append(hooks, h.String())
+	}
+	return "[" + strings.Join(hooks, " ") + "]"
+}
+
+func (v *hooksValue) Type() string {
+	return "hookArray"
+}
+
+func addSSHFlags(cmd *cobra.Command, cf *config.SSHConfig) {
+	flags := cmd.PersistentFlags()
+	flags.IntVar(&cf.Port, "ssh-port", 22, "ssh port of the meta and storage hosts")
+	flags.StringToIntVar(&cf.HostPorts, "ssh-host-port", nil, "ssh port of a host, e.g. 192.168.8.1=2222")
+	flags.StringArrayVar(&cf.KeyFiles, "ssh-key", nil, "ssh private key file, ~/.ssh/id_{rsa,ecdsa,ed25519} if not set")
+	flags.BoolVar(&cf.UseAgent, "ssh-agent", false, "authenticate with the keys of ssh-agent")
+	flags.BoolVar(&cf.ForwardAgent, "ssh-forward-agent", false, "forward ssh-agent to the remote hosts")
+	flags.StringVar(&cf.KnownHosts, "ssh-known-hosts", "", "known_hosts file to verify the host keys, ~/.ssh/known_hosts if not set")
+	flags.BoolVar(&cf.InsecureIgnoreHostKey, "ssh-insecure-ignore-host-key", false, "do not verify the host keys")
+	flags.StringSliceVar(&cf.Jump, "ssh-jump", nil, "jump hosts to connect the meta and storage hosts through, e.g. ops@bastion:22,bastion2")
+	flags.Var((*hostJumpsValue)(&cf.HostJumps), "ssh-host-jump", "jump hosts of a host, e.g. 192.168.8.1=ops@bastion, none for a direct connection")
+}
+
+func addMetaClientFlags(flags *pflag.FlagSet, cf *config.MetaClientConfig) {
+	flags.DurationVar(&cf.ConnectTimeout, "meta-connect-timeout", 10*time.Second, "timeout of connecting metad")
+	flags.DurationVar(&cf.Timeout, "meta-timeout", 120*time.Second, "timeout of a meta request")
+	flags.StringVar(&cf.Transport, "meta-transport", "buffered", "thrift transport of metad, buffered or framed")
+	flags.StringVar(&cf.Protocol, "meta-protocol", "binary", "thrift protocol of metad, binary or compact")
+	flags.IntVar(&cf.RetryTimes, "meta-retry", 5, "times a failed meta request is sent")
+	flags.DurationVar(&cf.RetryDelay, "meta-retry-delay", time.Second, "delay before the first retry of a meta request, doubled for every retry")
+}
+
+func addMetricsFlags(flags *pflag.FlagSet, cf *config.MetricsConfig) {
+	flags.StringVar(&cf.PushGateway, "metrics-push-gateway", "", "url of the Pushgateway the metrics are pushed to when br finishes, e.g. http://127.0.0.1:9091")
+	flags.StringVar(&cf.Job, "metrics-job", "br", "job name of the metrics pushed")
+	flags.StringVar(&cf.ListenAddr, "metrics-addr", "", "address serving /metrics while br is running, e.g. :9485")
+}
+
+func addHookFlags(flags *pflag.FlagSet, hooks *[]config.Hook, phases []string) {
+	flags.Var((*hooksValue)(hooks), "hook", "command run before or after a phase, locally or on the host over ssh as --storageuser if no user is given, "+
+		"<pre|post>-<phase>[@[user@]host]=<command>, the phases are "+strings.Join(phases, ","))
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const envPrefix = "BR_"
+
+var (
+	configFile string
+	profile    string
+)
+
+// AddConfigFlags lets every command read its flags from the environment and the config file,
+// the flags given on the command line win over the environment, which wins over the profile.
+func AddConfigFlags(rootCmd *cobra.Command) {
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "yaml or toml config file with the flags of the clusters, "+envPrefix+"CONFIG if not set")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "profile of the config file, the default one if not set")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := applyEnv(cmd.Flags()); err != nil {
+			return err
+		}
+		if configFile == "" {
+			return nil
+		}
+		f, err := config.LoadFile(configFile)
+		if err != nil {
+			return err
+		}
+		p, err := f.Profile(profile)
+		if err != nil {
+			return err
+		}
+		return applyProfile(cmd.Flags(), p, flagNames(cmd.Root()))
+	}
+}
+
+// envName is the environment variable of the flag, e.g. BR_SSH_PORT of --ssh-port.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// isMulti returns whether the flag can be set more than once.
+func isMulti(flag *pflag.Flag) bool {
+	t := flag.Value.Type()
+	return strings.HasSuffix(t, "Slice") || strings.HasSuffix(t, "Array") || strings.HasPrefix(t, "stringTo")
+}
+
+// applyEnv sets the flags not given on the command line from the environment,
+// the values of an array flag are separated by commas.
+func applyEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		value, ok := os.LookupEnv(envName(flag.Name))
+		if err != nil || !ok || flag.Changed {
+			return
+		}
+		values := []string{value}
+		if flag.Value.Type() == "stringArray" {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if e := flags.Set(flag.Name, v); e != nil {
+				err = fmt.Errorf("invalid %s: %v", envName(flag.Name), e)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// flagNames returns the flags of all the commands.
+func flagNames(cmd *cobra.Command) map[string]bool {
+	names := make(map[string]bool)
+	add := func(flag *pflag.Flag) { names[flag.Name] = true }
+	cmd.LocalFlags().VisitAll(add)
+	cmd.PersistentFlags().VisitAll(add)
+	for _, c := range cmd.Commands() {
+		for name := range flagNames(c) {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// profileValues converts a value of the config file to the values of a flag,
+// a list is several values and a map is several key=value.
+func profileValues(value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	case map[string]interface{}:
+		var values []string
+		for key, item := range v {
+			if list, ok := item.([]interface{}); ok {
+				values = append(values, key+"="+strings.Join(profileValues(list), ","))
+			} else {
+				values = append(values, key+"="+fmt.Sprint(item))
+			}
+		}
+		sort.Strings(values)
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// applyProfile sets the flags not given on the command line or the environment from the profile.
+// The options of the other commands are skipped, so a profile can be shared by all of them.
+func applyProfile(flags *pflag.FlagSet, p map[string]interface{}, known map[string]bool) error {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !known[name] || name == "config" || name == "profile" {
+			return fmt.Errorf("unknown option %s in the config file", name)
+		}
+		flag := flags.Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		values := profileValues(p[name])
+		if len(values) > 1 && !isMulti(flag) {
+			return fmt.Errorf("option %s in the config file has more than one value", name)
+		}
+		for _, v := range values {
+			if err := flags.Set(name, v); err != nil {
+				return fmt.Errorf("invalid option %s in the config file: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyConfig(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		meta    []string
+		backend string
+		user    string
+		port    int
+		ports   map[string]int
+		jumps   map[string][]string
+	)
+	flags := pflag.NewFlagSet("br", pflag.ContinueOnError)
+	flags.StringArrayVar(&meta, "meta", nil, "")
+	flags.StringVar(&backend, "backend", "", "")
+	flags.StringVar(&user, "metauser", "", "")
+	flags.IntVar(&port, "ssh-port", 22, "")
+	flags.StringToIntVar(&ports, "ssh-host-port", nil, "")
+	flags.Var((*hostJumpsValue)(&jumps), "ssh-host-jump", "")
+	known := map[string]bool{"meta": true, "backend": true, "metauser": true, "ssh-port": true, "ssh-host-port": true, "ssh-host-jump": true, "sdir": true}
+
+	// the command line wins over the environment, which wins over the profile
+	assert.NoError(flags.Parse([]string{"--backend", "local:///flag"}))
+	os.Setenv("BR_BACKEND", "local:///env")
+	os.Setenv("BR_META", "192.168.8.1:45500,192.168.8.2:45500")
+	defer os.Unsetenv("BR_BACKEND")
+	defer os.Unsetenv("BR_META")
+	assert.NoError(applyEnv(flags))
+
+	p := map[string]interface{}{
+		"meta":          []interface{}{"192.168.8.3:45500"},
+		"backend":       "local:///profile",
+		"metauser":      "nebula",
+		"ssh-port":      2222,
+		"ssh-host-port": map[string]interface{}{"192.168.8.1": 22},
+		"ssh-host-jump": map[string]interface{}{"192.168.8.1": []interface{}{"bastion", "bastion2"}},
+		// an option of another command is skipped
+		"sdir": "/data/storage",
+	}
+	assert.NoError(applyProfile(flags, p, known))
+	assert.Equal("local:///flag", backend)
+	assert.Equal([]string{"192.168.8.1:45500", "192.168.8.2:45500"}, meta)
+	assert.Equal("nebula", user)
+	assert.Equal(2222, port)
+	assert.Equal(map[string]int{"192.168.8.1": 22}, ports)
+	assert.Equal(map[string][]string{"192.168.8.1": {"bastion", "bastion2"}}, jumps)
+
+	assert.EqualError(applyProfile(flags, map[string]interface{}{"metaa": "x"}, known), "unknown option metaa in the config file")
+	flags = pflag.NewFlagSet("br", pflag.ContinueOnError)
+	flags.StringVar(&backend, "backend", "", "")
+	assert.EqualError(applyProfile(flags, map[string]interface{}{"backend": []interface{}{"a", "b"}}, known),
+		"option backend in the config file has more than one value")
+}
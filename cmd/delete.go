@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monadbobo/br/pkg/prune"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewDeleteCmd() *cobra.Command {
+	deleteCmd := &cobra.Command{
+		Use:   "delete <backup>...",
+		Short: "delete backups and drop their snapshots",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			deleteConfig.BackupNames = args
+			p, err := prune.NewPrune(deleteConfig, logger)
+			if err != nil {
+				return err
+			}
+			defer p.Close()
+
+			names, err := p.DeleteBackups(cmd.Context())
+			for _, name := range names {
+				printDeleted(name)
+			}
+			return err
+		},
+	}
+
+	addDeleteFlags(deleteCmd)
+	return deleteCmd
+}
+
+func NewPruneCmd() *cobra.Command {
+	var keepWithin string
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "delete the backups out of the retention",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			if keepWithin != "" {
+				d, err := prune.ParseDuration(keepWithin)
+				if err != nil {
+					return err
+				}
+				deleteConfig.KeepWithin = d
+			}
+
+			p, err := prune.NewPrune(deleteConfig, logger)
+			if err != nil {
+				return err
+			}
+			defer p.Close()
+
+			names, err := p.PruneBackups(cmd.Context())
+			for _, name := range names {
+				printDeleted(name)
+			}
+			return err
+		},
+	}
+
+	addDeleteFlags(pruneCmd)
+	pruneCmd.Flags().IntVar(&deleteConfig.KeepLast, "keep-last", 0, "keep the last N backups")
+	pruneCmd.Flags().StringVar(&keepWithin, "keep-within", "", "keep the backups created within the duration, e.g. 30d or 12h")
+	return pruneCmd
+}
+
+func addDeleteFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&deleteConfig.MetaAddrs, "meta", nil, "meta server url")
+	cmd.MarkFlagRequired("meta")
+	cmd.Flags().StringVar(&deleteConfig.BackendUrl, "backend", "", "backend url")
+	cmd.MarkFlagRequired("backend")
+	cmd.Flags().BoolVar(&deleteConfig.DryRun, "dry-run", false, "only print the backups to delete")
+	addMetaClientFlags(cmd.Flags(), &deleteConfig.MetaClient)
+}
+
+func printDeleted(name string) {
+	if deleteConfig.DryRun {
+		fmt.Printf("would delete %s\n", name)
+	} else {
+		fmt.Printf("deleted %s\n", name)
+	}
+}
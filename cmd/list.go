@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewListCmd() *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "list the backups in the backend",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			l, err := list.NewList(listConfig, logger)
+			if err != nil {
+				return err
+			}
+			backups, err := l.ListBackups()
+			if err != nil {
+				return err
+			}
+			return list.Print(os.Stdout, backups, listConfig.Output)
+		},
+	}
+
+	listCmd.Flags().StringVar(&listConfig.BackendUrl, "backend", "", "backend url")
+	listCmd.MarkFlagRequired("backend")
+	listCmd.Flags().StringVar(&listConfig.Output, "output", "table", "output format, table or json")
+
+	return listCmd
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/monadbobo/br/pkg/restore"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -29,6 +31,19 @@ func NewRestoreCMD() *cobra.Command {
 	restoreCmd.MarkPersistentFlagRequired("sdir")
 	restoreCmd.PersistentFlags().StringVar(&restoreConfig.MetaDataDir, "mdir", "", "meta data dir")
 	restoreCmd.MarkPersistentFlagRequired("mdir")
+	restoreCmd.PersistentFlags().StringVar(&restoreConfig.MetaStartCmd, "metastart", "",
+		"command run on the meta hosts to start metad after the meta files are restored, e.g. /usr/local/nebula/scripts/nebula.service start metad; "+
+			"if empty br does not start it and metad must be running before the restored files are sent to it, e.g. started by a pre-restore_meta hook")
+	restoreCmd.PersistentFlags().StringToStringVar(&restoreConfig.HostMap, "host-map", nil, "backup storage host to restore storage host, e.g. 192.168.8.1:44500=192.168.8.11:44500")
+	restoreCmd.PersistentFlags().StringVar(&restoreConfig.HostMapFile, "host-map-file", "", "file with one old=new storage host mapping per line")
+	restoreCmd.PersistentFlags().BoolVar(&restoreConfig.Overwrite, "overwrite", false, "restore even if the data dirs are not empty")
+	restoreCmd.PersistentFlags().DurationVar(&restoreConfig.ProgressInterval, "progress-interval", 10*time.Second, "interval of printing the progress, 0 to disable it")
+	restoreCmd.PersistentFlags().BoolVar(&restoreConfig.MoveAside, "move-aside", false, "move the non-empty data dirs to <dir>.br-<time> before the restore")
+
+	addSSHFlags(restoreCmd, &restoreConfig.SSH)
+	addMetaClientFlags(restoreCmd.PersistentFlags(), &restoreConfig.MetaClient)
+	addMetricsFlags(restoreCmd.PersistentFlags(), &restoreConfig.Metrics)
+	addHookFlags(restoreCmd.PersistentFlags(), &restoreConfig.Hooks, restore.Phases)
 
 	return restoreCmd
 }
@@ -43,8 +58,12 @@ func newFullRestoreCmd() *cobra.Command {
 
 			defer logger.Sync() // flushes buffer, if any
 
-			r := restore.NewRestore(restoreConfig, logger)
-			err := r.RestoreCluster()
+			r, err := restore.NewRestore(restoreConfig, logger)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			err = r.RestoreCluster(cmd.Context())
 			if err != nil {
 				return err
 			}
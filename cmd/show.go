@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/monadbobo/br/pkg/show"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewShowCmd() *cobra.Command {
+	showCmd := &cobra.Command{
+		Use:   "show <backup>",
+		Short: "show the meta of a backup",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			showConfig.BackupName = args[0]
+			s, err := show.NewShow(showConfig, logger)
+			if err != nil {
+				return err
+			}
+			info, err := s.ShowBackup()
+			if err != nil {
+				return err
+			}
+			return show.Print(os.Stdout, info, showConfig.Output)
+		},
+	}
+
+	showCmd.Flags().StringVar(&showConfig.BackendUrl, "backend", "", "backend url")
+	showCmd.MarkFlagRequired("backend")
+	showCmd.Flags().StringVar(&showConfig.Output, "output", "text", "output format, text or json")
+
+	return showCmd
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/monadbobo/br/pkg/verify"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewVerifyCmd() *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:          "verify <backup>",
+		Short:        "verify the files of a backup are complete and not corrupt",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, _ := zap.NewProduction()
+
+			defer logger.Sync() // flushes buffer, if any
+
+			verifyConfig.BackupName = args[0]
+			v, err := verify.NewVerify(verifyConfig, logger)
+			if err != nil {
+				return err
+			}
+			result, err := v.VerifyBackup()
+			if err != nil {
+				return err
+			}
+
+			for _, p := range result.Problems {
+				fmt.Println(p)
+			}
+			fmt.Printf("%d files checked, %d problems found\n", result.Checked, len(result.Problems))
+			if len(result.Problems) != 0 {
+				return fmt.Errorf("backup %s is broken", args[0])
+			}
+			return nil
+		},
+	}
+
+	verifyCmd.Flags().StringVar(&verifyConfig.BackendUrl, "backend", "", "backend url")
+	verifyCmd.MarkFlagRequired("backend")
+
+	return verifyCmd
+}
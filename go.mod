@@ -3,12 +3,17 @@ module github.com/monadbobo/br
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/facebook/fbthrift v0.0.0-20190922225929-2f9839604e25
+	github.com/prometheus/client_golang v1.8.0
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
+	github.com/stretchr/testify v1.6.1
 	github.com/vesoft-inc/nebula-clients/go v0.0.0-20201106023157-58e2fe8abd18
 	github.com/vesoft-inc/nebula-go/v2 v2.0.0-20200921074558-805846e2abd7 // indirect
 	go.uber.org/zap v1.16.0
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
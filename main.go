@@ -1,16 +1,46 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/monadbobo/br/cmd"
 	"github.com/spf13/cobra"
 )
 
+// signalContext is canceled on the first SIGINT or SIGTERM, which aborts the running
+// command gracefully, a second signal kills br at once.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			fmt.Fprintf(os.Stderr, "received %v, aborting, send it again to exit at once\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, cancel
+}
+
 func main() {
 
 	rootCmd := &cobra.Command{
 		Use:   "br",
 		Short: "BR is a Nebula backup and restore tool",
 	}
-	rootCmd.AddCommand(cmd.NewBackupCmd(), cmd.NewVersionCmd(), cmd.NewRestoreCMD())
-	rootCmd.Execute()
+	rootCmd.AddCommand(cmd.NewBackupCmd(), cmd.NewVersionCmd(), cmd.NewRestoreCMD(), cmd.NewListCmd(), cmd.NewShowCmd(), cmd.NewDeleteCmd(), cmd.NewPruneCmd(), cmd.NewVerifyCmd(), cmd.NewCleanupCmd(), cmd.NewCheckCmd())
+	cmd.AddConfigFlags(rootCmd)
+	ctx, cancel := signalContext()
+	err := rootCmd.ExecuteContext(ctx)
+	cancel()
+	if err != nil {
+		os.Exit(1)
+	}
 }
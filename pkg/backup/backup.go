@@ -1,30 +1,41 @@
 package backup
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/facebook/fbthrift/thrift/lib/go/thrift"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 
 	//	"github.com/vesoft-inc/nebula-clients/go/nebula/"
 	//	"github.com/vesoft-inc/nebula-clients/go/nebula/meta"
 
 	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/metrics"
 	"github.com/monadbobo/br/pkg/nebula"
 	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/progress"
+	"github.com/monadbobo/br/pkg/report"
 	"github.com/monadbobo/br/pkg/ssh"
 	"github.com/monadbobo/br/pkg/storage"
+	"github.com/monadbobo/br/pkg/version"
 )
 
-var defaultTimeout time.Duration = 120 * time.Second
 var tmpDir = "/tmp/"
 
 type BackupError struct {
@@ -37,113 +48,184 @@ type spaceInfo struct {
 	checkpointDir string
 }
 
-var LeaderNotFoundError = errors.New("not found leader")
-var backupFailed = errors.New("backup failed")
+var LeaderNotFoundError = metaclient.ErrLeaderNotFound
+
+// Phases are the phases of a backup the hooks can be run around, backup is the whole run.
+var Phases = []string{"backup", "check", "create_backup", "upload", "upload_meta_file"}
 
 func (e *BackupError) Error() string {
 	return e.msg + e.Err.Error()
 }
 
 type Backup struct {
-	client         *meta.MetaServiceClient
+	meta           metaclient.Interface
 	config         config.BackupConfig
 	metaAddr       string
 	backendStorage storage.ExternalStorage
+	ssh            *ssh.Pool
 	log            *zap.Logger
 	metaFileName   string
+	// the manifest of the base backup of an incremental backup
+	base     *manifest.Manifest
+	manifest *manifest.Manifest
+	progress *progress.Progress
+	metrics  *metrics.Metrics
+	report   *report.Report
+	hooks    *hook.Runner
+	// the backup name set to the backend, empty before the backup is created
+	backupName string
+	// the id of the cluster read from a storage host, 0 if unknown
+	clusterID int64
+	mutex     sync.Mutex
+	startTime time.Time
 }
 
-func NewBackupClient(cf config.BackupConfig, log *zap.Logger) *Backup {
+func NewBackupClient(cf config.BackupConfig, log *zap.Logger) (*Backup, error) {
+	if err := cf.Validate(); err != nil {
+		return nil, err
+	}
 	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
 	if err != nil {
 		log.Error("new external storage failed", zap.Error(err))
-		return nil
+		return nil, err
+	}
+	client, err := metaclient.New(cf.MetaAddrs, cf.MetaClient, log)
+	if err != nil {
+		return nil, err
+	}
+	pool := ssh.NewPool(cf.SSH, log)
+	hooks, err := hook.New("backup", cf.Hooks, Phases, pool, cf.StorageUser, log)
+	if err != nil {
+		return nil, err
 	}
-	return &Backup{config: cf, backendStorage: backend, log: log}
+	hooks.SetSpaces(cf.SpaceNames)
+	return &Backup{config: cf, backendStorage: backend, ssh: pool, meta: client, hooks: hooks,
+		metrics: metrics.New("backup", cf.Metrics, log), report: report.New(os.Args, cf), log: log}, nil
 }
 
 func hostaddrToString(host *nebula.HostAddr) string {
-	return host.Host + ":" + string(host.Port)
+	return metaclient.HostAddrString(host)
 }
 
-func (b *Backup) CheckEnv() bool {
-	return true
+// Open connects to the meta service, the first reachable address of --meta is used.
+func (b *Backup) Open(ctx context.Context) error {
+	return b.meta.Open(ctx)
 }
 
-func (b *Backup) Open(addr string) error {
+// observePhase records the duration of the phase in the metrics and the report.
+func (b *Backup) observePhase(phase string, start time.Time) {
+	b.metrics.ObservePhase(phase, start)
+	b.report.ObservePhase(phase, start)
+}
 
-	if b.client != nil {
-		if err := b.client.Transport.Close(); err != nil {
-			b.log.Warn("close backup falied", zap.Error(err))
-		}
+// failure records the error of the phase in the metrics and the report.
+func (b *Backup) failure(phase string, err error) {
+	b.metrics.Failure(phase, err)
+	b.report.Failure(phase, err)
+}
+
+// Close closes the meta client, the ssh connections and the metrics endpoint.
+func (b *Backup) Close() error {
+	b.ssh.Close()
+	b.metrics.Close()
+	return b.meta.Close()
+}
+
+func (b *Backup) CreateBackup(ctx context.Context) (*meta.CreateBackupResp, error) {
+	backupReq := meta.NewCreateBackupReq()
+	for _, name := range b.config.SpaceNames {
+		backupReq.SpaceName = append(backupReq.SpaceName, []byte(name))
 	}
 
-	timeoutOption := thrift.SocketTimeout(defaultTimeout)
-	addressOption := thrift.SocketAddr(addr)
-	sock, err := thrift.NewSocket(timeoutOption, addressOption)
+	resp, err := b.meta.CreateBackup(ctx, backupReq)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	// the meta files of the backup are on the leader
+	b.metaAddr = b.meta.Addr()
+	return resp, nil
+}
 
-	transport := thrift.NewBufferedTransport(sock, 128<<10)
+// cleanup drops the snapshot of a failed backup and removes what was uploaded,
+// the checkpoints of the storage hosts are dropped with the snapshot.
+func (b *Backup) cleanup(ctx context.Context, name string) {
+	b.log.Info("cleanup failed backup", zap.String("backup", name))
+	// the backup may be aborted, the cleanup should still be done
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	if err := b.meta.DropSnapshot(ctx, name); err != nil {
+		b.log.Error("drop snapshot failed, drop it with br cleanup", zap.String("backup", name), zap.Error(err))
+	}
+	if err := b.backendStorage.Remove(name); err != nil {
+		b.log.Error("remove the partial backup failed", zap.String("backup", name), zap.Error(err))
+	}
+}
 
-	pf := thrift.NewBinaryProtocolFactoryDefault()
-	client := meta.NewMetaServiceClientFactory(transport, pf)
-	if err := client.Transport.Open(); err != nil {
+// checkSpaces makes sure every space given by --space exists in the cluster.
+func (b *Backup) checkSpaces(ctx context.Context) error {
+	if len(b.config.SpaceNames) == 0 {
+		return nil
+	}
+
+	spaces, err := b.meta.ListSpaces(ctx)
+	if err != nil {
 		return err
 	}
-	b.metaAddr = addr
-	b.client = client
-	return nil
-}
 
-func (b *Backup) Close() error {
-	if b.client != nil {
-		if err := b.client.Transport.Close(); err != nil {
-			return err
-		}
+	exist := make(map[string]bool)
+	for _, s := range spaces {
+		exist[string(s.GetName())] = true
 	}
-	return nil
-}
 
-func (b *Backup) CreateBackup(count int) (*meta.CreateBackupResp, error) {
-	for {
-		if count == 0 {
-			return nil, LeaderNotFoundError
+	var missing []string
+	seen := make(map[string]bool)
+	for _, name := range b.config.SpaceNames {
+		if seen[name] {
+			return fmt.Errorf("space %s is given more than once", name)
 		}
-		backupReq := meta.NewCreateBackupReq()
-		defer b.client.Transport.Close()
-
-		resp, err := b.client.CreateBackup(backupReq)
-		if err != nil {
-			return nil, err
+		seen[name] = true
+		if !exist[name] {
+			missing = append(missing, name)
 		}
+	}
 
-		if resp.GetCode() != meta.ErrorCode_E_LEADER_CHANGED && resp.GetCode() != meta.ErrorCode_SUCCEEDED {
-			b.log.Error("backup failed", zap.String("error code", resp.GetCode().String()))
-			return nil, backupFailed
-		}
+	if len(missing) != 0 {
+		return fmt.Errorf("spaces not found: %s", strings.Join(missing, ","))
+	}
+	return nil
+}
 
-		if resp.GetCode() == meta.ErrorCode_SUCCEEDED {
-			return resp, nil
-		}
+// checkBackupSpaces makes sure the backup meta covers exactly the requested spaces,
+// the BackupInfo of the meta file is the record of the spaces in this backup.
+func (b *Backup) checkBackupSpaces(m *meta.BackupMeta) error {
+	var names []string
+	for _, info := range m.GetBackupInfo() {
+		names = append(names, string(info.GetSpace().GetSpaceName()))
+	}
+	b.log.Info("backup spaces", zap.String("backup", m.GetBackupName()), zap.Strings("spaces", names))
 
-		leader := resp.GetLeader()
-		if leader == meta.ExecResp_Leader_DEFAULT {
-			return nil, LeaderNotFoundError
-		}
+	if len(b.config.SpaceNames) == 0 {
+		return nil
+	}
 
-		// we need reconnect the new leader
-		err = b.Open(hostaddrToString(leader))
-		if err != nil {
-			return nil, err
+	covered := make(map[string]bool)
+	for _, name := range names {
+		covered[name] = true
+	}
+	for _, name := range b.config.SpaceNames {
+		if !covered[name] {
+			return fmt.Errorf("space %s is not in the backup %s", name, m.GetBackupName())
 		}
-		count--
 	}
+	if len(names) != len(b.config.SpaceNames) {
+		return fmt.Errorf("backup %s has unexpected spaces: %s", m.GetBackupName(), strings.Join(names, ","))
+	}
+	return nil
 }
 
 func (b *Backup) writeMetadata(meta *meta.BackupMeta) error {
-	b.metaFileName = tmpDir + meta.BackupName + ".meta"
+	b.metaFileName = tmpDir + metafile.Name(meta.BackupName)
 
 	file, err := os.OpenFile(b.metaFileName, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
@@ -152,51 +234,216 @@ func (b *Backup) writeMetadata(meta *meta.BackupMeta) error {
 
 	defer file.Close()
 
-	trans := thrift.NewStreamTransport(file, file)
-
-	binaryOut := thrift.NewBinaryProtocol(trans, false, true)
-	defer trans.Close()
 	var absMetaFiles []string
 	for _, files := range meta.MetaFiles {
 		f := filepath.Base(files)
 		absMetaFiles = append(absMetaFiles, f)
 	}
 	meta.MetaFiles = absMetaFiles
-	err = meta.Write(binaryOut)
+	return metafile.Write(file, meta)
+}
+
+// clusterIDFile is the cluster.id storaged saves in its working dir,
+// it holds the id of the cluster given by metad as a binary int64.
+const clusterIDFile = "/proc/$(pgrep -o -x nebula-storaged)/cwd/cluster.id"
+
+// clusterIDCommand prints the cluster id in the file as a decimal.
+func clusterIDCommand(file string) string {
+	return "od -An -t d8 " + file
+}
+
+// readClusterID reads the cluster id from an online storage host, metad only gives it in
+// the heartbeat of a storage host, which br can't send without changing the state of metad.
+// It is 0 if no host can tell it.
+func (b *Backup) readClusterID(ctx context.Context) int64 {
+	hosts, err := b.meta.ListHosts(ctx, meta.HostRole_STORAGE)
+	if err != nil {
+		b.log.Warn("list storage hosts failed, the cluster id is unknown", zap.Error(err))
+		return 0
+	}
+	for _, h := range hosts {
+		if h.GetStatus() != meta.HostStatus_ONLINE || h.GetHostAddr() == nil {
+			continue
+		}
+		ip := h.GetHostAddr().GetHost()
+		out, err := b.ssh.ExecCommandOutput(ctx, ip, b.config.StorageUser, clusterIDCommand(clusterIDFile))
+		if err == nil {
+			var id int64
+			if id, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64); err == nil {
+				return id
+			}
+		}
+		b.log.Warn("read cluster id failed", zap.String("host", ip), zap.Error(err))
+	}
+	b.log.Warn("no storage host tells the cluster id, the manifest is written without it")
+	return 0
+}
+
+// loadBase loads the manifest of the base backup, only the complete backups of the same
+// cluster can be the base. The files are reused by their checksums, which must be recorded.
+func (b *Backup) loadBase() error {
+	if b.config.BaseBackup == "" {
+		return nil
+	}
+	if b.config.NoChecksum {
+		return fmt.Errorf("incremental backup reuses the files by their checksums, it can't be taken with --no-checksum")
+	}
+
+	objects, err := b.backendStorage.ListObjects(b.config.BaseBackup)
 	if err != nil {
 		return err
 	}
-	binaryOut.Flush()
+
+	var complete, hasManifest bool
+	for _, o := range objects {
+		switch path.Base(o.Path) {
+		case metafile.Name(b.config.BaseBackup):
+			complete = true
+		case manifest.Name(b.config.BaseBackup):
+			hasManifest = true
+		}
+	}
+	if !complete {
+		return fmt.Errorf("base backup %s is not found or not complete", b.config.BaseBackup)
+	}
+	if !hasManifest {
+		return fmt.Errorf("base backup %s has no manifest", b.config.BaseBackup)
+	}
+
+	base, err := manifest.Load(b.backendStorage, b.config.BaseBackup)
+	if err != nil {
+		return err
+	}
+	if b.clusterID == 0 || base.ClusterID != b.clusterID {
+		return fmt.Errorf("base backup %s is not taken from this cluster (cluster id %d, this cluster %d), take a full backup instead",
+			b.config.BaseBackup, base.ClusterID, b.clusterID)
+	}
+	b.base = base
+	b.log.Info("incremental backup", zap.String("base", b.config.BaseBackup))
 	return nil
 }
 
-func (b *Backup) BackupCluster() error {
+// BackupCluster backs up the cluster, the remote commands are killed when ctx is done.
+func (b *Backup) BackupCluster(ctx context.Context) (err error) {
+	b.startTime = time.Now()
+	defer func() {
+		if err == nil {
+			var spaces []string
+			for _, s := range b.manifest.Spaces {
+				spaces = append(spaces, s.SpaceName)
+			}
+			b.metrics.BackupSucceeded(spaces)
+		}
+		b.metrics.Finish(err)
+		b.writeReport(ctx, err)
+		// the post hooks of the backup run after the report is stored
+		b.hooks.Post(ctx, "backup", err)
+	}()
+	if err = b.metrics.Serve(); err != nil {
+		b.log.Error("serve metrics failed", zap.Error(err))
+		return err
+	}
+	if err = b.hooks.Pre(ctx, "backup"); err != nil {
+		b.failure("backup", err)
+		return err
+	}
 
-	resp, err := b.CreateBackup(3)
+	err = b.hooks.Run(ctx, "check", func() error {
+		if err := b.checkSpaces(ctx); err != nil {
+			b.log.Error("check spaces failed", zap.Error(err))
+			return err
+		}
+		b.clusterID = b.readClusterID(ctx)
+		if err := b.loadBase(); err != nil {
+			b.log.Error("load base backup failed", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		b.failure("check", err)
+		return err
+	}
+	b.observePhase("check", b.startTime)
+
+	start := time.Now()
+	var resp *meta.CreateBackupResp
+	err = b.hooks.Run(ctx, "create_backup", func() (err error) {
+		resp, err = b.CreateBackup(ctx)
+		if err == nil {
+			b.setBackupName(resp.GetMeta().GetBackupName())
+		}
+		return err
+	})
 	if err != nil {
 		b.log.Error("backup cluster failed", zap.Error(err))
+		if errors.As(err, new(*metaclient.SentError)) {
+			b.log.Error("the backup may have been created by metad, drop its snapshot with br cleanup")
+		}
+		b.failure("create_backup", err)
 		return err
 	}
+	b.observePhase("create_backup", start)
 
 	meta := resp.GetMeta()
-	err = b.UploadAll(meta)
+	err = b.checkBackupSpaces(meta)
+	if err != nil {
+		b.log.Error("check backup spaces failed", zap.Error(err))
+		b.failure("create_backup", err)
+		b.cleanup(ctx, meta.GetBackupName())
+		return err
+	}
+
+	err = b.UploadAll(ctx, meta)
 	if err != nil {
+		if ctx.Err() != nil {
+			b.log.Warn("backup aborted", zap.String("backup", meta.GetBackupName()), zap.Error(ctx.Err()))
+		}
+		b.cleanup(ctx, meta.GetBackupName())
 		return err
 	}
 
 	return nil
 }
 
-func (b *Backup) uploadMeta(g *errgroup.Group, files []string) {
+func (b *Backup) uploadMeta(ctx context.Context, g *errgroup.Group, files []string) {
 
 	b.log.Info("will upload meta", zap.Int("sst file count", len(files)))
 	cmd := b.backendStorage.BackupMetaCommand(files)
 	b.log.Info("start upload meta", zap.String("addr", b.metaAddr))
 	ipAddr := strings.Split(b.metaAddr, ":")
-	g.Go(func() error { return ssh.ExecCommandBySSH(ipAddr[0], b.config.MetaUser, cmd, b.log) })
+	start := time.Now()
+	g.Go(func() error {
+		out, err := b.ssh.ExecCommandOutput(ctx, ipAddr[0], b.config.MetaUser, manifest.FileListCommand(!b.config.NoChecksum, files...))
+		if err != nil {
+			b.failure("upload_meta", err)
+			return err
+		}
+		metaFiles, err := manifest.ParseFileList(out)
+		if err != nil {
+			b.failure("upload_meta", err)
+			return err
+		}
+		for i := range metaFiles {
+			metaFiles[i].Path = filepath.Base(metaFiles[i].Path)
+		}
+
+		err = b.copy(ctx, b.progress.Add(ipAddr[0], "meta", metaFiles), b.config.MetaUser, cmd, "")
+		if err != nil {
+			b.failure("upload_meta", err)
+			return err
+		}
+		b.observePhase("upload_meta", start)
+
+		b.mutex.Lock()
+		b.manifest.MetaFiles = metaFiles
+		b.mutex.Unlock()
+		return nil
+	})
 }
 
-func (b *Backup) uploadStorage(g *errgroup.Group, dirs map[string][]spaceInfo) {
+func (b *Backup) uploadStorage(ctx context.Context, g *errgroup.Group, dirs map[string][]spaceInfo) {
+	start := time.Now()
 	for k, v := range dirs {
 		b.log.Info("start upload storage", zap.String("addr", k))
 		idMap := make(map[string]string)
@@ -207,17 +454,140 @@ func (b *Backup) uploadStorage(g *errgroup.Group, dirs map[string][]spaceInfo) {
 
 		ipAddrs := strings.Split(k, ":")
 		for id2, cp := range idMap {
-			cmd := b.backendStorage.BackupStorageCommand(cp, ipAddrs[0], id2)
+			id, dir := id2, cp
+			g.Go(func() error {
+				err := b.uploadSpace(ctx, ipAddrs[0], id, dir)
+				if err != nil {
+					b.failure("upload_storage", err)
+					return err
+				}
+				b.observePhase("upload_storage", start)
+				return nil
+			})
+		}
+	}
+}
+
+func isSstFile(file string) bool {
+	return strings.HasPrefix(file, "data/") && strings.HasSuffix(file, ".sst")
+}
+
+// listCheckpointFiles returns the files of the data and wal dirs of the checkpoint.
+func (b *Backup) listCheckpointFiles(ctx context.Context, ip string, cpDir string) ([]manifest.File, error) {
+	cmd := "cd " + cpDir + " && " + manifest.FileListCommand(!b.config.NoChecksum, "data", "wal")
+	out, err := b.ssh.ExecCommandOutput(ctx, ip, b.config.StorageUser, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.ParseFileList(out)
+}
+
+// reuseBase returns the files of the space for the manifest and the ones to upload. The sst
+// files are immutable, so the ones of the base backup with the same name, size and checksum
+// are not uploaded again, they refer to the backup keeping them instead. The files without
+// a checksum are always uploaded.
+func reuseBase(base *manifest.Manifest, ip string, spaceID string, files []manifest.File) (*manifest.StorageFiles, []manifest.File) {
+	baseFiles := make(map[string]manifest.File)
+	if base != nil {
+		if s := base.Find(ip, spaceID); s != nil {
+			for _, f := range s.Files {
+				if f.Backup == "" {
+					f.Backup = base.BackupName
+				}
+				baseFiles[f.Path] = f
+			}
+		}
+	}
+
+	sf := &manifest.StorageFiles{Host: ip, SpaceID: spaceID}
+	upload := []manifest.File{}
+	for _, f := range files {
+		if bf, ok := baseFiles[f.Path]; ok && isSstFile(f.Path) && bf.Size == f.Size &&
+			f.SHA256 != "" && bf.SHA256 == f.SHA256 {
+			f.Backup = bf.Backup
+		} else {
+			upload = append(upload, f)
+		}
+		sf.Files = append(sf.Files, f)
+	}
+	return sf, upload
+}
+
+// uploadSpace uploads the checkpoint of a space on a storage host, an incremental
+// backup only uploads the files not reused from the base backup.
+func (b *Backup) uploadSpace(ctx context.Context, ip string, spaceID string, cpDir string) error {
+	files, err := b.listCheckpointFiles(ctx, ip, cpDir)
+	if err != nil {
+		return err
+	}
+
+	sf, uploadFiles := reuseBase(b.base, ip, spaceID, files)
+	var cmd, fileList string
+	if b.base == nil {
+		cmd = b.backendStorage.BackupStorageCommand(cpDir, ip, spaceID)
+	} else {
+		b.log.Info("incremental upload", zap.String("addr", ip), zap.String("space", spaceID),
+			zap.Int("upload", len(uploadFiles)), zap.Int("reuse", len(files)-len(uploadFiles)))
+		var upload []string
+		for _, f := range uploadFiles {
+			upload = append(upload, f.Path)
+		}
+		cmd = b.backendStorage.BackupStorageFilesCommand(cpDir, ip, spaceID)
+		fileList = storage.FileList(upload)
+	}
+
+	err = b.copy(ctx, b.progress.Add(ip, spaceID, uploadFiles), b.config.StorageUser, cmd, fileList)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.manifest.Storage = append(b.manifest.Storage, sf)
+	b.mutex.Unlock()
+	return nil
+}
+
+// copy runs the command copying the files of the task with the file list as its stdin,
+// the progress is updated with the files printed by the command.
+func (b *Backup) copy(ctx context.Context, task *progress.Task, user string, cmd string, fileList string) error {
+	task.Start()
+	err := b.ssh.ExecCommandLines(ctx, task.Host, user, cmd, b.backendStorage.Env(), fileList, func(line string) {
+		if src, _, ok := b.backendStorage.CopiedFile(line); ok {
+			task.Copied(src)
+		}
+	})
+	task.Finish(err)
+	return err
+}
 
-			g.Go(func() error { return ssh.ExecCommandBySSH(ipAddrs[0], b.config.StorageUser, cmd, b.log) })
+func (b *Backup) writeManifest() (string, error) {
+	b.manifest.EndTime = time.Now()
+	sort.Slice(b.manifest.Storage, func(i, j int) bool {
+		if b.manifest.Storage[i].Host == b.manifest.Storage[j].Host {
+			return b.manifest.Storage[i].SpaceID < b.manifest.Storage[j].SpaceID
 		}
+		return b.manifest.Storage[i].Host < b.manifest.Storage[j].Host
+	})
+
+	fileName := tmpDir + manifest.Name(b.manifest.BackupName)
+	file, err := os.OpenFile(fileName, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return "", err
 	}
+	defer file.Close()
+
+	return fileName, manifest.Write(file, b.manifest)
 }
 
-func (b *Backup) uploadMetaFile() error {
-	cmdStr := b.backendStorage.BackupMetaFileCommand(b.metaFileName)
+// uploadFile uploads a local file into the backup dir of the backend.
+func (b *Backup) uploadFile(ctx context.Context, fileName string) error {
+	return b.runBackendCommand(ctx, b.backendStorage.BackupMetaFileCommand(fileName))
+}
 
-	cmd := exec.Command(cmdStr[0], cmdStr[1:]...)
+func (b *Backup) runBackendCommand(ctx context.Context, cmdStr []string) error {
+	cmd := exec.CommandContext(ctx, cmdStr[0], cmdStr[1:]...)
+	cmd.Env = append(os.Environ(), b.backendStorage.Env()...)
 	err := cmd.Run()
 	if err != nil {
 		return err
@@ -227,11 +597,21 @@ func (b *Backup) uploadMetaFile() error {
 	return nil
 }
 
-func (b *Backup) execPreCommand(backupName string) error {
-	b.backendStorage.SetBackupName(backupName)
+// setBackupName sets the backup name to the backend once.
+func (b *Backup) setBackupName(name string) {
+	if b.backupName == "" {
+		b.backupName = name
+		b.backendStorage.SetBackupName(name)
+		b.hooks.SetBackupName(name)
+	}
+}
+
+func (b *Backup) execPreCommand(ctx context.Context, backupName string) error {
+	b.setBackupName(backupName)
 	cmdStr := b.backendStorage.BackupPreCommand()
 
-	cmd := exec.Command(cmdStr[0], cmdStr[1:]...)
+	cmd := exec.CommandContext(ctx, cmdStr[0], cmdStr[1:]...)
+	cmd.Env = append(os.Environ(), b.backendStorage.Env()...)
 	err := cmd.Run()
 	if err != nil {
 		return err
@@ -241,33 +621,69 @@ func (b *Backup) execPreCommand(backupName string) error {
 	return nil
 }
 
-func (b *Backup) UploadAll(meta *meta.BackupMeta) error {
-	//upload meta
-	g, _ := errgroup.WithContext(context.Background())
+// writeReport uploads the report into the backup dir, the report of a failed backup, whose dir
+// is removed by the cleanup, is stored as <backup>.json in the reports dir of the backend instead.
+// The report is not stored if no backup was created.
+func (b *Backup) writeReport(ctx context.Context, err error) {
+	if b.report == nil {
+		return
+	}
+	b.report.Finish(b.backupName, err, ctx.Err() != nil)
+	if b.backupName == "" {
+		b.log.Warn("no backup created, the report is not stored")
+		return
+	}
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
 
-	err := b.execPreCommand(meta.GetBackupName())
-	if err != nil {
-		return err
+	dir, e := ioutil.TempDir("", "br-report")
+	if e != nil {
+		b.log.Error("write the report failed", zap.Error(e))
+		return
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, report.Name)
+	file, e := os.Create(fileName)
+	if e != nil {
+		b.log.Error("write the report failed", zap.Error(e))
+		return
+	}
+	e = b.report.Write(file)
+	file.Close()
+	if e != nil {
+		b.log.Error("write the report failed", zap.Error(e))
+		return
 	}
 
-	b.uploadMeta(g, meta.GetMetaFiles())
-	//upload storage
-	storageMap := make(map[string][]spaceInfo)
-	for k, v := range meta.GetBackupInfo() {
-		for _, f := range v.GetCpDirs() {
-			cpDir := spaceInfo{k, string(f.CheckpointDir)}
-			storageMap[hostaddrToString(f.Host)] = append(storageMap[hostaddrToString(f.Host)], cpDir)
-		}
+	cmd, stored := b.backendStorage.BackupMetaFileCommand(fileName), report.Name
+	if err != nil {
+		name := b.backupName + ".json"
+		cmd, stored = b.backendStorage.ReportFileCommand(fileName, name), storage.ReportDir+"/"+name
+	}
+	if e := b.runBackendCommand(ctx, cmd); e != nil {
+		b.log.Error("upload the report failed", zap.Error(e))
+		return
 	}
-	b.uploadStorage(g, storageMap)
+	b.log.Info("report stored", zap.String("backup", b.backupName), zap.String("file", stored))
+}
 
-	err = g.Wait()
+// uploadMetaFiles uploads the manifest and the meta file of the backup.
+func (b *Backup) uploadMetaFiles(ctx context.Context, meta *meta.BackupMeta) error {
+	start := time.Now()
+	// the manifest must be uploaded before the meta file, which marks the backup complete
+	manifestFile, err := b.writeManifest()
 	if err != nil {
-		b.log.Error("upload error")
+		b.log.Error("write the manifest failed", zap.Error(err))
+		return err
+	}
+	err = b.uploadFile(ctx, manifestFile)
+	if err != nil {
+		b.log.Error("upload manifest failed", zap.Error(err))
 		return err
 	}
-	// write the meta for this backup to local
 
+	// write the meta for this backup to local
 	err = b.writeMetadata(meta)
 	if err != nil {
 		b.log.Error("write the meta file failed", zap.Error(err))
@@ -275,13 +691,92 @@ func (b *Backup) UploadAll(meta *meta.BackupMeta) error {
 	}
 	b.log.Info("write meta data finished")
 	// upload meta file
-	err = b.uploadMetaFile()
+	err = b.uploadFile(ctx, b.metaFileName)
 	if err != nil {
 		b.log.Error("upload meta file failed", zap.Error(err))
 		return err
 	}
+	b.observePhase("upload_meta_file", start)
+	return nil
+}
+
+func (b *Backup) UploadAll(ctx context.Context, meta *meta.BackupMeta) error {
+	err := b.execPreCommand(ctx, meta.GetBackupName())
+	if err != nil {
+		b.failure("upload_meta_file", err)
+		return err
+	}
+
+	b.manifest = &manifest.Manifest{
+		Version:    manifest.Version,
+		BackupName: meta.GetBackupName(),
+		BrVersion:  version.Version,
+		MetaAddrs:  b.config.MetaAddrs,
+		StartTime:  b.startTime,
+	}
+	if b.base != nil {
+		b.manifest.BaseBackup = b.base.BackupName
+	}
+	b.manifest.ClusterID = b.clusterID
+	for id, info := range meta.GetBackupInfo() {
+		b.manifest.Spaces = append(b.manifest.Spaces, manifest.Space{SpaceID: int32(id), SpaceName: string(info.GetSpace().GetSpaceName())})
+	}
+	sort.Slice(b.manifest.Spaces, func(i, j int) bool { return b.manifest.Spaces[i].SpaceID < b.manifest.Spaces[j].SpaceID })
+	var spaces []string
+	for _, s := range b.manifest.Spaces {
+		spaces = append(spaces, s.SpaceName)
+	}
+	b.hooks.SetSpaces(spaces)
+
+	b.progress = progress.New()
+	err = b.hooks.Run(ctx, "upload", func() error { return b.upload(ctx, meta) })
+	if err != nil {
+		if errors.As(err, new(*hook.Error)) {
+			b.failure("upload", err)
+		}
+		return err
+	}
+
+	err = b.hooks.Run(ctx, "upload_meta_file", func() error { return b.uploadMetaFiles(ctx, meta) })
+	if err != nil {
+		b.failure("upload_meta_file", err)
+		return err
+	}
 
 	b.log.Info("upload done")
 
 	return nil
 }
+
+// upload uploads the meta and the storage files of the backup, the first failed upload cancels the others.
+func (b *Backup) upload(ctx context.Context, meta *meta.BackupMeta) error {
+	if b.config.ProgressInterval > 0 {
+		stop := b.progress.Start(os.Stderr, b.config.ProgressInterval)
+		defer stop()
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	//upload meta
+	b.uploadMeta(gctx, g, meta.GetMetaFiles())
+	//upload storage
+	storageMap := make(map[string][]spaceInfo)
+	for k, v := range meta.GetBackupInfo() {
+		for _, f := range v.GetCpDirs() {
+			cpDir := spaceInfo{k, string(f.CheckpointDir)}
+			storageMap[hostaddrToString(f.Host)] = append(storageMap[hostaddrToString(f.Host)], cpDir)
+		}
+	}
+	b.uploadStorage(gctx, g, storageMap)
+
+	err := g.Wait()
+	b.progress.Summary(os.Stdout)
+	for host, bytes := range b.progress.HostBytes() {
+		b.metrics.SetBytes(host, bytes)
+	}
+	b.report.SetHosts(b.progress.Results())
+	if err != nil {
+		b.log.Error("upload error")
+		return err
+	}
+	return nil
+}
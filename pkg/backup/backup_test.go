@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/report"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+type fakeMeta struct {
+	spaces  []string
+	dropped []string
+}
+
+func (m *fakeMeta) Open(ctx context.Context) error { return nil }
+func (m *fakeMeta) Close() error                   { return nil }
+func (m *fakeMeta) Addr() string                   { return "127.0.0.1:9559" }
+
+func (m *fakeMeta) CreateBackup(ctx context.Context, req *meta.CreateBackupReq) (*meta.CreateBackupResp, error) {
+	return nil, nil
+}
+
+func (m *fakeMeta) ListSpaces(ctx context.Context) ([]*meta.IdName, error) {
+	var spaces []*meta.IdName
+	for _, s := range m.spaces {
+		spaces = append(spaces, &meta.IdName{Name: []byte(s)})
+	}
+	return spaces, nil
+}
+
+func (m *fakeMeta) ListHosts(ctx context.Context, role meta.HostRole) ([]*meta.HostItem, error) {
+	return nil, nil
+}
+
+func (m *fakeMeta) ListSnapshots(ctx context.Context) ([]*meta.Snapshot, error) {
+	return nil, nil
+}
+
+func (m *fakeMeta) DropSnapshot(ctx context.Context, name string) error {
+	m.dropped = append(m.dropped, name)
+	return nil
+}
+
+func (m *fakeMeta) RestoreMeta(ctx context.Context, req *meta.RestoreMetaReq) error {
+	return nil
+}
+
+func TestCheckSpaces(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+
+	b := &Backup{meta: &fakeMeta{spaces: []string{"nba", "test"}}, log: log}
+	assert.NoError(b.checkSpaces(ctx))
+
+	b.config.SpaceNames = []string{"nba"}
+	assert.NoError(b.checkSpaces(ctx))
+
+	b.config.SpaceNames = []string{"nba", "nba"}
+	assert.Error(b.checkSpaces(ctx))
+
+	b.config.SpaceNames = []string{"nba", "foo"}
+	assert.EqualError(b.checkSpaces(ctx), "spaces not found: foo")
+}
+
+func TestCleanup(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-backup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	name := "BACKUP_2020_11_10_10_00_00"
+	assert.NoError(os.MkdirAll(filepath.Join(dir, name, "meta"), 0755))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "BACKUP_2020_11_09_10_00_00"), 0755))
+
+	backend, err := storage.NewExternalStorage("local://"+dir, log)
+	assert.NoError(err)
+	m := &fakeMeta{}
+	b := &Backup{config: config.BackupConfig{}, meta: m, backendStorage: backend, log: log}
+
+	// the backup is aborted
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.cleanup(ctx, name)
+
+	assert.Equal([]string{name}, m.dropped)
+	_, err = os.Stat(filepath.Join(dir, name))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "BACKUP_2020_11_09_10_00_00"))
+	assert.NoError(err)
+}
+
+func TestWriteReport(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-backup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	backend, err := storage.NewExternalStorage("local://"+dir, log)
+	assert.NoError(err)
+	cf := config.BackupConfig{BackendUrl: "local://" + dir}
+	b := &Backup{config: cf, meta: &fakeMeta{}, backendStorage: backend, report: report.New([]string{"br", "backup", "full"}, cf), log: log}
+
+	// the failed backup was removed by the cleanup
+	name := "BACKUP_2020_11_10_10_00_00"
+	b.setBackupName(name)
+	b.failure("upload_storage", errors.New("disk full"))
+	b.writeReport(context.Background(), errors.New("disk full"))
+
+	// it is kept out of the backup dirs
+	_, err = os.Stat(filepath.Join(dir, name))
+	assert.True(os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(dir, storage.ReportDir, name+".json"))
+	assert.NoError(err)
+	var r report.Report
+	assert.NoError(json.Unmarshal(data, &r))
+	assert.Equal(name, r.BackupName)
+	assert.Equal("failed", r.Status)
+	assert.Equal([]string{"br", "backup", "full"}, r.CommandLine)
+	assert.Equal([]report.Error{{Phase: "upload_storage", Message: "disk full"}}, r.Errors)
+}
+
+func TestReuseBase(t *testing.T) {
+	assert := assert.New(t)
+	base := &manifest.Manifest{
+		BackupName: "BACKUP_2",
+		BaseBackup: "BACKUP_1",
+		Storage: []*manifest.StorageFiles{
+			{Host: "192.168.8.1", SpaceID: "1", Files: []manifest.File{
+				{Path: "data/000010.sst", Size: 10, SHA256: "a", Backup: "BACKUP_1"},
+				{Path: "data/000011.sst", Size: 20, SHA256: "b"},
+				{Path: "data/000012.sst", Size: 30, SHA256: "c"},
+				{Path: "data/000013.sst", Size: 40, SHA256: "d"},
+				{Path: "data/MANIFEST-000001", Size: 5, SHA256: "e"},
+			}},
+			{Host: "192.168.8.2", SpaceID: "1", Files: []manifest.File{
+				{Path: "data/000014.sst", Size: 50, SHA256: "f"},
+			}},
+		},
+	}
+	files := []manifest.File{
+		{Path: "data/000010.sst", Size: 10, SHA256: "a"},
+		{Path: "data/000011.sst", Size: 20, SHA256: "b"},
+		{Path: "data/000012.sst", Size: 30, SHA256: "x"},
+		{Path: "data/000013.sst", Size: 41, SHA256: "d"},
+		{Path: "data/000014.sst", Size: 50, SHA256: "f"},
+		{Path: "data/MANIFEST-000001", Size: 5, SHA256: "e"},
+		{Path: "wal/1/0001.wal", Size: 6, SHA256: "g"},
+	}
+
+	// the unchanged sst files refer to the backup keeping them, the base or the one it reused them from
+	sf, upload := reuseBase(base, "192.168.8.1", "1", files)
+	assert.Equal("192.168.8.1", sf.Host)
+	assert.Equal("1", sf.SpaceID)
+	assert.Equal([]manifest.File{
+		{Path: "data/000010.sst", Size: 10, SHA256: "a", Backup: "BACKUP_1"},
+		{Path: "data/000011.sst", Size: 20, SHA256: "b", Backup: "BACKUP_2"},
+		{Path: "data/000012.sst", Size: 30, SHA256: "x"},
+		{Path: "data/000013.sst", Size: 41, SHA256: "d"},
+		{Path: "data/000014.sst", Size: 50, SHA256: "f"},
+		{Path: "data/MANIFEST-000001", Size: 5, SHA256: "e"},
+		{Path: "wal/1/0001.wal", Size: 6, SHA256: "g"},
+	}, sf.Files)
+	assert.Equal(files[2:], upload)
+
+	// a space not in the base and a full backup upload everything
+	sf, upload = reuseBase(base, "192.168.8.1", "2", files)
+	assert.Equal(files, sf.Files)
+	assert.Equal(files, upload)
+	sf, upload = reuseBase(nil, "192.168.8.1", "1", files)
+	assert.Equal(files, sf.Files)
+	assert.Equal(files, upload)
+
+	// the files without a checksum are never reused
+	files = []manifest.File{
+		{Path: "data/000011.sst", Size: 20},
+		{Path: "data/000013.sst", Size: 41},
+	}
+	sf, upload = reuseBase(base, "192.168.8.1", "1", files)
+	assert.Equal(files, sf.Files)
+	assert.Equal(files, upload)
+	base.Storage[0].Files[1].SHA256 = ""
+	_, upload = reuseBase(base, "192.168.8.1", "1", []manifest.File{{Path: "data/000011.sst", Size: 20, SHA256: "b"}})
+	assert.Equal([]manifest.File{{Path: "data/000011.sst", Size: 20, SHA256: "b"}}, upload)
+}
+
+func TestLoadBase(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-backup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	name := "BACKUP_2020_11_10_10_00_00"
+	assert.NoError(os.MkdirAll(filepath.Join(dir, name), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, name, metafile.Name(name)), nil, 0644))
+	var buf bytes.Buffer
+	assert.NoError(manifest.Write(&buf, &manifest.Manifest{BackupName: name, ClusterID: 42}))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, name, manifest.Name(name)), buf.Bytes(), 0644))
+
+	backend, err := storage.NewExternalStorage("local://"+dir, log)
+	assert.NoError(err)
+	b := &Backup{config: config.BackupConfig{BaseBackup: name}, backendStorage: backend, clusterID: 42, log: log}
+	assert.NoError(b.loadBase())
+	assert.Equal(name, b.base.BackupName)
+
+	// the base of another cluster, or of an unknown one, is refused
+	b = &Backup{config: config.BackupConfig{BaseBackup: name}, backendStorage: backend, clusterID: 43, log: log}
+	assert.EqualError(b.loadBase(), "base backup "+name+" is not taken from this cluster (cluster id 42, this cluster 43), take a full backup instead")
+	assert.Nil(b.base)
+	b.clusterID = 0
+	assert.Error(b.loadBase())
+
+	// the files can't be reused without the checksums
+	b = &Backup{config: config.BackupConfig{BaseBackup: name, NoChecksum: true}, backendStorage: backend, clusterID: 42, log: log}
+	assert.Error(b.loadBase())
+
+	b = &Backup{config: config.BackupConfig{BaseBackup: "BACKUP_2020_11_09_10_00_00"}, backendStorage: backend, clusterID: 42, log: log}
+	assert.EqualError(b.loadBase(), "base backup BACKUP_2020_11_09_10_00_00 is not found or not complete")
+}
+
+func TestClusterIDCommand(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "br-backup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// storaged writes the id as a binary int64
+	file := filepath.Join(dir, "cluster.id")
+	id := make([]byte, 8)
+	binary.LittleEndian.PutUint64(id, 5127362127128)
+	assert.NoError(ioutil.WriteFile(file, id, 0644))
+	out, err := exec.Command("sh", "-c", clusterIDCommand(file)).Output()
+	assert.NoError(err)
+	assert.Equal("5127362127128", strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,297 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/ssh"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// Item is a line of the checklist.
+type Item struct {
+	Name   string
+	Host   string
+	Passed bool
+	Detail string
+}
+
+// executor runs the commands on the hosts, an *ssh.Pool but in the tests.
+type executor interface {
+	ExecCommandEnv(ctx context.Context, addr string, user string, cmd string, env []string) error
+	ExecCommandOutput(ctx context.Context, addr string, user string, cmd string) (string, error)
+	Close() error
+}
+
+// Check checks the cluster and the hosts are ready for a backup with the same flags.
+type Check struct {
+	config  config.BackupConfig
+	meta    metaclient.Interface
+	backend storage.ExternalStorage
+	ssh     executor
+	log     *zap.Logger
+
+	mutex sync.Mutex
+	items []Item
+}
+
+func NewCheck(cf config.BackupConfig, log *zap.Logger) (*Check, error) {
+	if err := cf.ValidateCheck(); err != nil {
+		return nil, err
+	}
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	if err != nil {
+		return nil, err
+	}
+	client, err := metaclient.New(cf.MetaAddrs, cf.MetaClient, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Check{config: cf, meta: client, backend: backend, ssh: ssh.NewPool(cf.SSH, log), log: log}, nil
+}
+
+func (c *Check) Close() error {
+	c.ssh.Close()
+	return c.meta.Close()
+}
+
+func (c *Check) add(item Item) {
+	c.mutex.Lock()
+	c.items = append(c.items, item)
+	c.mutex.Unlock()
+}
+
+// checkHosts checks the hosts of the role known by meta are online and returns their addresses.
+func (c *Check) checkHosts(ctx context.Context, role meta.HostRole) ([]string, bool) {
+	name := strings.ToLower(role.String()) + " online"
+	hosts, err := c.meta.ListHosts(ctx, role)
+	if err != nil {
+		c.add(Item{Name: name, Detail: err.Error()})
+		return nil, false
+	}
+	if len(hosts) == 0 {
+		c.add(Item{Name: name, Detail: "no host found"})
+	}
+
+	var addrs []string
+	for _, h := range hosts {
+		addr := metaclient.HostAddrString(h.GetHostAddr())
+		addrs = append(addrs, addr)
+		c.add(Item{Name: name, Host: addr, Passed: h.GetStatus() == meta.HostStatus_ONLINE, Detail: h.GetStatus().String()})
+	}
+	return addrs, true
+}
+
+// diff returns the addresses only in a and the ones only in b.
+func diff(a []string, b []string) ([]string, []string) {
+	inA, inB := make(map[string]bool), make(map[string]bool)
+	for _, s := range a {
+		inA[s] = true
+	}
+	for _, s := range b {
+		inB[s] = true
+	}
+
+	var onlyA, onlyB []string
+	for s := range inA {
+		if !inB[s] {
+			onlyA = append(onlyA, s)
+		}
+	}
+	for s := range inB {
+		if !inA[s] {
+			onlyB = append(onlyB, s)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return onlyA, onlyB
+}
+
+// checkStorageList checks --storage is the storage hosts known by meta.
+func (c *Check) checkStorageList(hosts []string) {
+	missing, unknown := diff(hosts, c.config.StorageAddrs)
+	var details []string
+	if len(missing) != 0 {
+		details = append(details, "not in --storage: "+strings.Join(missing, ","))
+	}
+	if len(unknown) != 0 {
+		details = append(details, "unknown to meta: "+strings.Join(unknown, ","))
+	}
+	c.add(Item{Name: "storage list", Passed: len(details) == 0, Detail: strings.Join(details, "; ")})
+}
+
+// estimate is what every host uploaded in the last complete backup.
+type estimate struct {
+	backup string
+	// meta is the size of the meta files, any metad may be the leader uploading them
+	meta int64
+	// storage is the size of the files of every storage host by ip
+	storage map[string]int64
+}
+
+// estimateSize reads the sizes from the manifest of the last complete backup,
+// nil if there is no backup or it has no manifest.
+func (c *Check) estimateSize() (*estimate, error) {
+	l, err := list.NewList(config.ListConfig{BackendUrl: c.config.BackendUrl}, c.log)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := l.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	last := ""
+	for _, b := range backups {
+		if b.Complete {
+			last = b.Name
+		}
+	}
+	if last == "" {
+		return nil, nil
+	}
+	m, err := manifest.Load(c.backend, last)
+	if err != nil {
+		c.log.Warn("read the manifest of the last backup failed", zap.String("backup", last), zap.Error(err))
+		return nil, nil
+	}
+
+	e := &estimate{backup: last, storage: make(map[string]int64)}
+	for _, f := range m.MetaFiles {
+		e.meta += f.Size
+	}
+	// the files reused from the base are counted, the next backup may be a full one
+	for _, s := range m.Storage {
+		for _, f := range s.Files {
+			e.storage[s.Host] += f.Size
+		}
+	}
+	return e, nil
+}
+
+// checkHost checks the host can be logged in, can write the backend and has enough free
+// space in the backend if it is a local disk, for the size it uploaded in the backup,
+// which is empty if the host has no share in the last backup.
+func (c *Check) checkHost(ctx context.Context, addr string, user string, backup string, size int64) {
+	ip := strings.Split(addr, ":")[0]
+	err := c.ssh.ExecCommandEnv(ctx, ip, user, c.backend.CheckWriteCommand(ip), c.backend.Env())
+	if err != nil {
+		c.add(Item{Name: "backend write", Host: addr, Detail: err.Error()})
+		return
+	}
+	c.add(Item{Name: "backend write", Host: addr, Passed: true, Detail: c.backend.URI()})
+
+	cmd := c.backend.FreeSpaceCommand()
+	if cmd == "" {
+		return
+	}
+	out, err := c.ssh.ExecCommandOutput(ctx, ip, user, cmd)
+	if err != nil {
+		c.add(Item{Name: "free space", Host: addr, Detail: err.Error()})
+		return
+	}
+	kb, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		c.add(Item{Name: "free space", Host: addr, Detail: fmt.Sprintf("unexpected df output: %q", out)})
+		return
+	}
+
+	free := kb * 1024
+	item := Item{Name: "free space", Host: addr, Passed: free >= size}
+	if backup == "" {
+		item.Detail = fmt.Sprintf("free %s, no backup to estimate the size", list.FormatSize(free))
+	} else {
+		item.Detail = fmt.Sprintf("free %s, uploaded %s in %s", list.FormatSize(free), list.FormatSize(size), backup)
+	}
+	c.add(item)
+}
+
+// Run runs all the checks, the items of the same check are sorted by host.
+func (c *Check) Run(ctx context.Context) []Item {
+	c.items = nil
+
+	if _, ok := c.checkHosts(ctx, meta.HostRole_META); ok {
+		if storageHosts, ok := c.checkHosts(ctx, meta.HostRole_STORAGE); ok {
+			c.checkStorageList(storageHosts)
+		}
+	}
+
+	e, err := c.estimateSize()
+	if err != nil {
+		c.add(Item{Name: "backend list", Detail: err.Error()})
+	}
+	if e == nil {
+		e = &estimate{}
+	}
+
+	var wg sync.WaitGroup
+	// size returns the share of the host in the last backup, false if it has none
+	check := func(addrs []string, user string, size func(ip string) (int64, bool)) {
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				backup := ""
+				n, ok := size(strings.Split(addr, ":")[0])
+				if ok {
+					backup = e.backup
+				}
+				c.checkHost(ctx, addr, user, backup, n)
+			}(addr)
+		}
+	}
+	check(c.config.MetaAddrs, c.config.MetaUser, func(string) (int64, bool) { return e.meta, e.backup != "" })
+	check(c.config.StorageAddrs, c.config.StorageUser, func(ip string) (int64, bool) {
+		n, ok := e.storage[ip]
+		return n, ok
+	})
+	wg.Wait()
+
+	order := make(map[string]int)
+	for _, item := range c.items {
+		if _, ok := order[item.Name]; !ok {
+			order[item.Name] = len(order)
+		}
+	}
+	sort.SliceStable(c.items, func(i, j int) bool {
+		if c.items[i].Name != c.items[j].Name {
+			return order[c.items[i].Name] < order[c.items[j].Name]
+		}
+		return c.items[i].Host < c.items[j].Host
+	})
+	return c.items
+}
+
+// Print prints the checklist and returns the number of the failed items.
+func Print(w io.Writer, items []Item) int {
+	failed := 0
+	for _, item := range items {
+		status := "PASS"
+		if !item.Passed {
+			status = "FAIL"
+			failed++
+		}
+		line := fmt.Sprintf("[%s] %s", status, item.Name)
+		if item.Host != "" {
+			line += " " + item.Host
+		}
+		if item.Detail != "" {
+			line += ": " + item.Detail
+		}
+		fmt.Fprintln(w, line)
+	}
+	return failed
+}
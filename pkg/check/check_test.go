@@ -0,0 +1,164 @@
+package check
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+type fakeMeta struct {
+	metaclient.Interface
+	hosts map[meta.HostRole][]*meta.HostItem
+}
+
+func (m *fakeMeta) ListHosts(ctx context.Context, role meta.HostRole) ([]*meta.HostItem, error) {
+	return m.hosts[role], nil
+}
+
+func TestCheckHosts(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	host := func(ip string, port int, status meta.HostStatus) *meta.HostItem {
+		return &meta.HostItem{HostAddr: &nebula.HostAddr{Host: ip, Port: nebula.Port(port)}, Status: status}
+	}
+	m := &fakeMeta{hosts: map[meta.HostRole][]*meta.HostItem{
+		meta.HostRole_META: {host("192.168.8.1", 9559, meta.HostStatus_ONLINE)},
+		meta.HostRole_STORAGE: {
+			host("192.168.8.2", 9779, meta.HostStatus_OFFLINE),
+			host("192.168.8.1", 9779, meta.HostStatus_ONLINE),
+		},
+	}}
+	c := &Check{config: config.BackupConfig{StorageAddrs: []string{"192.168.8.1:9779", "192.168.8.3:9779"}}, meta: m, log: log}
+
+	_, ok := c.checkHosts(context.Background(), meta.HostRole_META)
+	assert.True(ok)
+	addrs, ok := c.checkHosts(context.Background(), meta.HostRole_STORAGE)
+	assert.True(ok)
+	c.checkStorageList(addrs)
+
+	var out bytes.Buffer
+	assert.Equal(2, Print(&out, c.items))
+	assert.Equal(`[PASS] meta online 192.168.8.1:9559: ONLINE
+[FAIL] storage online 192.168.8.2:9779: OFFLINE
+[PASS] storage online 192.168.8.1:9779: ONLINE
+[FAIL] storage list: not in --storage: 192.168.8.2:9779; unknown to meta: 192.168.8.3:9779
+`, out.String())
+}
+
+// fakeSSH answers the write check and df of every host.
+type fakeSSH struct {
+	writeErr map[string]error
+	freeKB   map[string]string
+}
+
+func (s *fakeSSH) ExecCommandEnv(ctx context.Context, addr string, user string, cmd string, env []string) error {
+	return s.writeErr[addr]
+}
+
+func (s *fakeSSH) ExecCommandOutput(ctx context.Context, addr string, user string, cmd string) (string, error) {
+	return s.freeKB[addr], nil
+}
+
+func (s *fakeSSH) Close() error { return nil }
+
+func writeManifest(t *testing.T, dir string, m *manifest.Manifest) {
+	if err := os.MkdirAll(filepath.Join(dir, m.BackupName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, m.BackupName, manifest.Name(m.BackupName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := manifest.Write(f, m); err != nil {
+		t.Fatal(err)
+	}
+	// the meta file makes the backup complete
+	if err := ioutil.WriteFile(filepath.Join(dir, m.BackupName, metafile.Name(m.BackupName)), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-check")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	host := func(ip string, port int) *meta.HostItem {
+		return &meta.HostItem{HostAddr: &nebula.HostAddr{Host: ip, Port: nebula.Port(port)}, Status: meta.HostStatus_ONLINE}
+	}
+	m := &fakeMeta{hosts: map[meta.HostRole][]*meta.HostItem{
+		meta.HostRole_META: {host("192.168.8.1", 9559)},
+		meta.HostRole_STORAGE: {
+			host("192.168.8.1", 9779),
+			host("192.168.8.2", 9779),
+			host("192.168.8.3", 9779),
+		},
+	}}
+	cf := config.BackupConfig{
+		BackendUrl:   "local://" + dir,
+		MetaAddrs:    []string{"192.168.8.1:9559"},
+		StorageAddrs: []string{"192.168.8.1:9779", "192.168.8.2:9779", "192.168.8.3:9779"},
+	}
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	assert.NoError(err)
+	fake := &fakeSSH{
+		writeErr: map[string]error{"192.168.8.3": errors.New("permission denied")},
+		freeKB:   map[string]string{"192.168.8.1": "3072\n", "192.168.8.2": "1024\n"},
+	}
+	c := &Check{config: cf, meta: m, backend: backend, ssh: fake, log: log}
+
+	// no backup to estimate the sizes
+	var out bytes.Buffer
+	assert.Equal(1, Print(&out, c.Run(context.Background())))
+	assert.Contains(out.String(), "[PASS] free space 192.168.8.2:9779: free 1.0MiB, no backup to estimate the size\n")
+
+	// every host is compared with its own share of the last backup, the reused files
+	// are counted and 192.168.8.2 had no share
+	writeManifest(t, dir, &manifest.Manifest{BackupName: "BACKUP_1",
+		MetaFiles: []manifest.File{{Path: "__edges__.sst", Size: 1 << 20}}})
+	writeManifest(t, dir, &manifest.Manifest{BackupName: "BACKUP_2",
+		MetaFiles: []manifest.File{{Path: "__edges__.sst", Size: 2 << 20}},
+		Storage: []*manifest.StorageFiles{
+			{Host: "192.168.8.1", SpaceID: "1", Files: []manifest.File{{Path: "data/000012.sst", Size: 2 << 20}}},
+			{Host: "192.168.8.1", SpaceID: "2", Files: []manifest.File{{Path: "data/000013.sst", Size: 2 << 20, Backup: "BACKUP_1"}}},
+		}})
+	later := time.Now().Add(time.Hour)
+	assert.NoError(os.Chtimes(filepath.Join(dir, "BACKUP_2", metafile.Name("BACKUP_2")), later, later))
+	assert.NoError(os.Chtimes(filepath.Join(dir, "BACKUP_2", manifest.Name("BACKUP_2")), later, later))
+
+	out.Reset()
+	assert.Equal(2, Print(&out, c.Run(context.Background())))
+	assert.Equal(`[PASS] meta online 192.168.8.1:9559: ONLINE
+[PASS] storage online 192.168.8.1:9779: ONLINE
+[PASS] storage online 192.168.8.2:9779: ONLINE
+[PASS] storage online 192.168.8.3:9779: ONLINE
+[PASS] storage list
+[PASS] backend write 192.168.8.1:9559: `+dir+`
+[PASS] backend write 192.168.8.1:9779: `+dir+`
+[PASS] backend write 192.168.8.2:9779: `+dir+`
+[FAIL] backend write 192.168.8.3:9779: permission denied
+[PASS] free space 192.168.8.1:9559: free 3.0MiB, uploaded 2.0MiB in BACKUP_2
+[FAIL] free space 192.168.8.1:9779: free 3.0MiB, uploaded 4.0MiB in BACKUP_2
+[PASS] free space 192.168.8.2:9779: free 1.0MiB, no backup to estimate the size
+`, out.String())
+}
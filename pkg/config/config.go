@@ -1,5 +1,50 @@
 package config
 
+import "time"
+
+// SSHConfig is how br connects to the meta and storage hosts.
+type SSHConfig struct {
+	// Port is the default port, HostPorts overrides it per host
+	Port      int
+	HostPorts map[string]int
+	// KeyFiles are the private keys, ~/.ssh/id_{rsa,ecdsa,ed25519} if empty
+	KeyFiles     []string
+	UseAgent     bool
+	ForwardAgent bool
+	// KnownHosts is ~/.ssh/known_hosts if empty
+	KnownHosts            string
+	InsecureIgnoreHostKey bool
+	// Jump are the hops to every host like ProxyJump, [user@]host[:port],
+	// HostJumps overrides them per host, "none" connects the host directly
+	Jump      []string
+	HostJumps map[string][]string
+}
+
+// MetaClientConfig is how br talks to the meta service, it must match
+// the thrift transport and protocol of metad.
+type MetaClientConfig struct {
+	ConnectTimeout time.Duration
+	// Timeout is the read and write timeout of a request
+	Timeout time.Duration
+	// Transport is buffered or framed
+	Transport string
+	// Protocol is binary or compact
+	Protocol string
+	// a failed request is sent RetryTimes times at most, the delay
+	// between them starts from RetryDelay and doubles up to MaxRetryDelay
+	RetryTimes    int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// MetricsConfig is where the metrics of a backup or a restore go, they are
+// pushed to PushGateway and served on ListenAddr during the run if set.
+type MetricsConfig struct {
+	PushGateway string
+	Job         string
+	ListenAddr  string
+}
+
 type BackupConfig struct {
 	MetaAddrs    []string
 	StorageAddrs []string
@@ -7,6 +52,17 @@ type BackupConfig struct {
 	BackendUrl   string
 	StorageUser  string
 	MetaUser     string
+	// the base backup of an incremental backup, empty for a full backup
+	BaseBackup string
+	// NoChecksum leaves the sha256 of the files out of the manifest, they are not read once more
+	// before the upload, but verify only checks the sizes and the files can't be reused
+	NoChecksum bool
+	// the progress is printed every ProgressInterval, never if it is 0
+	ProgressInterval time.Duration
+	SSH              SSHConfig
+	MetaClient       MetaClientConfig
+	Metrics          MetricsConfig
+	Hooks            []Hook
 }
 
 type RestoreConfig struct {
@@ -18,4 +74,48 @@ type RestoreConfig struct {
 	BackupName     string
 	StorageDataDir string
 	MetaDataDir    string
+	// MetaStartCmd starts metad on the meta hosts after the meta files are restored,
+	// br does not start it if empty, it is started by other means before restore_meta
+	MetaStartCmd string
+	// backup storage host -> restore storage host, both in ip:port
+	HostMap     map[string]string
+	HostMapFile string
+	// restore into the non-empty data dirs
+	Overwrite bool
+	// move the non-empty data dirs aside before the restore
+	MoveAside        bool
+	ProgressInterval time.Duration
+	SSH              SSHConfig
+	MetaClient       MetaClientConfig
+	Metrics          MetricsConfig
+	Hooks            []Hook
+}
+
+type ListConfig struct {
+	BackendUrl string
+	Output     string
+}
+
+type ShowConfig struct {
+	BackendUrl string
+	BackupName string
+	Output     string
+}
+
+// DeleteConfig is used by both delete and prune, prune selects the backups by the keep rules.
+type DeleteConfig struct {
+	MetaAddrs   []string
+	BackendUrl  string
+	BackupNames []string
+	KeepLast    int
+	KeepWithin  time.Duration
+	// Grace is the age a snapshot reaches before cleanup drops it
+	Grace      time.Duration
+	DryRun     bool
+	MetaClient MetaClientConfig
+}
+
+type VerifyConfig struct {
+	BackendUrl string
+	BackupName string
 }
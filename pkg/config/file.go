@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the config file of br, a profile is the flags of a cluster by their
+// names without "--", e.g.
+//
+//	default: prod
+//	profiles:
+//	  prod:
+//	    meta: [192.168.8.1:45500]
+//	    backend: local:///data/backup
+//	    ssh-host-port: {192.168.8.1: 2222}
+type File struct {
+	// Default is the profile used if --profile is not given
+	Default  string                            `yaml:"default" toml:"default"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles" toml:"profiles"`
+}
+
+// LoadFile loads a toml file if its extension is .toml, a yaml file otherwise.
+func LoadFile(name string) (*File, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{}
+	if filepath.Ext(name) == ".toml" {
+		err = toml.Unmarshal(data, f)
+	} else {
+		err = yaml.Unmarshal(data, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s failed: %v", name, err)
+	}
+	return f, nil
+}
+
+// Profile returns the profile of the name, the default one if the name is empty.
+func (f *File) Profile(name string) (map[string]interface{}, error) {
+	if name == "" {
+		name = f.Default
+	}
+	if name == "" && len(f.Profiles) == 1 {
+		for n := range f.Profiles {
+			name = n
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no default profile, choose one of %s with --profile", strings.Join(f.names(), ","))
+	}
+
+	p, ok := f.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not found, the profiles are %s", name, strings.Join(f.names(), ","))
+	}
+	return p, nil
+}
+
+func (f *File) names() []string {
+	var names []string
+	for n := range f.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "br-config")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	yamlFile := filepath.Join(dir, "br.yaml")
+	assert.NoError(ioutil.WriteFile(yamlFile, []byte(`
+default: prod
+profiles:
+  prod:
+    meta: [192.168.8.1:45500]
+    ssh-host-port: {192.168.8.1: 2222}
+  test:
+    backend: local:///data/backup
+`), 0644))
+	tomlFile := filepath.Join(dir, "br.toml")
+	assert.NoError(ioutil.WriteFile(tomlFile, []byte(`
+[profiles.prod]
+meta = ["192.168.8.1:45500"]
+
+[profiles.prod.ssh-host-port]
+"192.168.8.1" = 2222
+`), 0644))
+
+	f, err := LoadFile(yamlFile)
+	assert.NoError(err)
+	p, err := f.Profile("")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"192.168.8.1:45500"}, p["meta"])
+	p, err = f.Profile("test")
+	assert.NoError(err)
+	assert.Equal("local:///data/backup", p["backend"])
+	_, err = f.Profile("staging")
+	assert.EqualError(err, "profile staging not found, the profiles are prod,test")
+
+	// the only profile is the default one
+	f, err = LoadFile(tomlFile)
+	assert.NoError(err)
+	p, err = f.Profile("")
+	assert.NoError(err)
+	assert.Equal([]interface{}{"192.168.8.1:45500"}, p["meta"])
+	assert.Equal(map[string]interface{}{"192.168.8.1": int64(2222)}, p["ssh-host-port"])
+
+	assert.NoError(ioutil.WriteFile(yamlFile, []byte("profiles: [\n"), 0644))
+	_, err = LoadFile(yamlFile)
+	assert.Error(err)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	b := BackupConfig{
+		MetaAddrs:    []string{"192.168.8.1:45500"},
+		StorageAddrs: []string{"192.168.8.1:44500"},
+		BackendUrl:   "local:///data/backup",
+		StorageUser:  "nebula",
+		MetaUser:     "nebula",
+	}
+	assert.NoError(b.Validate())
+	b.StorageAddrs = []string{"192.168.8.1"}
+	assert.EqualError(b.Validate(), "invalid --storage 192.168.8.1, it should be ip:port")
+	b.StorageAddrs = []string{"192.168.8.1:445000"}
+	assert.EqualError(b.Validate(), "invalid port of --storage 192.168.8.1:445000")
+	b.StorageAddrs = []string{"192.168.8.1:44500"}
+	assert.NoError(b.ValidateCheck())
+
+	// a backup does not need --storage, but check does
+	b.StorageAddrs = nil
+	assert.NoError(b.Validate())
+	assert.EqualError(b.ValidateCheck(), "--storage is required")
+	b.MetaUser = ""
+	assert.EqualError(b.Validate(), "--metauser is required")
+
+	r := RestoreConfig{
+		MetaAddrs:      b.MetaAddrs,
+		StorageAddrs:   []string{"192.168.8.1:44500"},
+		BackendUrl:     b.BackendUrl,
+		StorageUser:    "nebula",
+		MetaUser:       "nebula",
+		BackupName:     "BACKUP_2020_11_20_10_00_00",
+		StorageDataDir: "/data/storage",
+		MetaDataDir:    "/data/meta",
+	}
+	assert.NoError(r.Validate())
+	r.MetaDataDir = "data/meta"
+	assert.Error(r.Validate())
+	r.MetaDataDir = "/data/meta; rm -rf /"
+	assert.Error(r.Validate())
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hook is a command run before or after a phase of a backup or a restore,
+// on Host over ssh if it is set, on the machine running br otherwise.
+type Hook struct {
+	// When is pre or post
+	When  string
+	Phase string
+	// User is the user of the remote host, the default one of the command if empty
+	User    string
+	Host    string
+	Command string
+}
+
+// ParseHook parses a hook formatted as <pre|post>-<phase>[@[user@]host]=<command>,
+// e.g. pre-create_backup@ops@192.168.8.1=/opt/etl/pause.sh
+func ParseHook(s string) (Hook, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+		return Hook{}, fmt.Errorf("hook %s must be formatted as <pre|post>-<phase>[@[user@]host]=<command>", s)
+	}
+
+	h := Hook{Command: kv[1]}
+	name := kv[0]
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, h.Host = name[:i], name[i+1:]
+		if i := strings.LastIndex(h.Host, "@"); i >= 0 {
+			h.User, h.Host = h.Host[:i], h.Host[i+1:]
+		}
+		if h.Host == "" {
+			return Hook{}, fmt.Errorf("hook %s has no host after @", s)
+		}
+	}
+
+	whenPhase := strings.SplitN(name, "-", 2)
+	if len(whenPhase) != 2 || (whenPhase[0] != "pre" && whenPhase[0] != "post") || whenPhase[1] == "" {
+		return Hook{}, fmt.Errorf("hook %s should start with pre-<phase> or post-<phase>", s)
+	}
+	h.When, h.Phase = whenPhase[0], whenPhase[1]
+	return h, nil
+}
+
+func (h Hook) String() string {
+	s := h.When + "-" + h.Phase
+	if h.Host != "" {
+		s += "@"
+		if h.User != "" {
+			s += h.User + "@"
+		}
+		s += h.Host
+	}
+	return s + "=" + h.Command
+}
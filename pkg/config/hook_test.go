@@ -0,0 +1,29 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHook(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := ParseHook("pre-create_backup=/opt/etl/pause.sh --all")
+	assert.NoError(err)
+	assert.Equal(Hook{When: "pre", Phase: "create_backup", Command: "/opt/etl/pause.sh --all"}, h)
+
+	h, err = ParseHook("post-upload@ops@192.168.8.1=curl -d status=$BR_STATUS http://ticket")
+	assert.NoError(err)
+	assert.Equal(Hook{When: "post", Phase: "upload", User: "ops", Host: "192.168.8.1", Command: "curl -d status=$BR_STATUS http://ticket"}, h)
+	assert.Equal("post-upload@ops@192.168.8.1=curl -d status=$BR_STATUS http://ticket", h.String())
+
+	h, err = ParseHook("post-restore@192.168.8.1=warm.sh")
+	assert.NoError(err)
+	assert.Equal(Hook{When: "post", Phase: "restore", Host: "192.168.8.1", Command: "warm.sh"}, h)
+
+	for _, s := range []string{"pre-backup", "pre-backup=", "during-backup=ls", "pre=ls", "pre-backup@=ls", "backup=ls"} {
+		_, err = ParseHook(s)
+		assert.Error(err, s)
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+func validateAddrs(name string, addrs []string) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("--%s is required", name)
+	}
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid --%s %s, it should be ip:port", name, addr)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port of --%s %s", name, addr)
+		}
+	}
+	return nil
+}
+
+// validateRequired returns the error of the first empty value, the names are the flags.
+func validateRequired(nameValues ...string) error {
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		if nameValues[i+1] == "" {
+			return fmt.Errorf("--%s is required", nameValues[i])
+		}
+	}
+	return nil
+}
+
+func validateDir(name string, dir string) error {
+	if !path.IsAbs(dir) || strings.ContainsAny(dir, " \t\n;&|") {
+		return fmt.Errorf("invalid --%s %s, it should be an absolute path without spaces", name, dir)
+	}
+	return nil
+}
+
+// Validate checks the config of a backup is complete, the flags and the config file are both checked by it.
+// --storage is optional, a backup gets the storage hosts from meta.
+func (c *BackupConfig) Validate() error {
+	if err := validateAddrs("meta", c.MetaAddrs); err != nil {
+		return err
+	}
+	if len(c.StorageAddrs) != 0 {
+		if err := validateAddrs("storage", c.StorageAddrs); err != nil {
+			return err
+		}
+	}
+	return validateRequired("backend", c.BackendUrl, "storageuser", c.StorageUser, "metauser", c.MetaUser)
+}
+
+// ValidateCheck checks the config of br check, which compares --storage with the storage hosts of meta.
+func (c *BackupConfig) ValidateCheck() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return validateAddrs("storage", c.StorageAddrs)
+}
+
+// Validate checks the config of a restore is complete.
+func (c *RestoreConfig) Validate() error {
+	if err := validateAddrs("meta", c.MetaAddrs); err != nil {
+		return err
+	}
+	if err := validateAddrs("storage", c.StorageAddrs); err != nil {
+		return err
+	}
+	err := validateRequired("backend", c.BackendUrl, "storageuser", c.StorageUser, "metauser", c.MetaUser, "backupname", c.BackupName)
+	if err != nil {
+		return err
+	}
+	if err := validateDir("sdir", c.StorageDataDir); err != nil {
+		return err
+	}
+	return validateDir("mdir", c.MetaDataDir)
+}
@@ -0,0 +1,230 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/redact"
+	"github.com/monadbobo/br/pkg/ssh"
+)
+
+// Error is returned when a hook fails.
+type Error struct {
+	Hook config.Hook
+	Err  error
+}
+
+// newError wraps the error of the hook. The command of a failed remote hook is left out
+// of the error, it may carry a token and the error goes to the report and the post hooks.
+func newError(h config.Hook, err error) *Error {
+	var cmdErr *ssh.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Command != redact.Redacted {
+		e := *cmdErr
+		e.Command = redact.Redacted
+		err = &e
+	}
+	return &Error{Hook: h, Err: err}
+}
+
+// Error leaves the command out, it may carry a token and the error is passed to the post hooks.
+func (e *Error) Error() string {
+	if e.Hook.Host != "" {
+		return fmt.Sprintf("%s-%s hook on %s failed: %v", e.Hook.When, e.Hook.Phase, e.Hook.Host, e.Err)
+	}
+	return fmt.Sprintf("%s-%s hook failed: %v", e.Hook.When, e.Hook.Phase, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Runner runs the hooks of the phases of a backup or a restore in the order they are given.
+// The hooks get the run in the environment:
+//
+//	BR_COMMAND      backup or restore
+//	BR_HOOK         pre or post
+//	BR_PHASE        the phase of the hook
+//	BR_BACKUP_NAME  the name of the backup, empty before it is created
+//	BR_SPACES       the names of the spaces separated by commas
+//	BR_STATUS       running for a pre hook, succeeded, failed or aborted for a post hook
+//	BR_ERROR        the error of a failed phase in one line, the credentials in it are redacted
+//
+// A nil *Runner runs nothing.
+type Runner struct {
+	command string
+	hooks   []config.Hook
+	ssh     *ssh.Pool
+	// user is the user of the remote hooks without one
+	user string
+	log  *zap.Logger
+
+	mutex      sync.Mutex
+	backupName string
+	spaces     []string
+}
+
+// New creates the runner of the hooks of the command, the phases are the ones the hooks can be run around.
+func New(command string, hooks []config.Hook, phases []string, pool *ssh.Pool, user string, log *zap.Logger) (*Runner, error) {
+	known := make(map[string]bool)
+	for _, p := range phases {
+		known[p] = true
+	}
+	for _, h := range hooks {
+		if h.When != "pre" && h.When != "post" {
+			return nil, fmt.Errorf("hook %s should be run pre or post a phase", h)
+		}
+		if !known[h.Phase] {
+			return nil, fmt.Errorf("unknown phase %s of hook %s, the phases of %s are %s", h.Phase, h, command, strings.Join(phases, ","))
+		}
+	}
+	return &Runner{command: command, hooks: hooks, ssh: pool, user: user, log: log}, nil
+}
+
+func (r *Runner) SetBackupName(name string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	r.backupName = name
+	r.mutex.Unlock()
+}
+
+func (r *Runner) SetSpaces(spaces []string) {
+	if r == nil {
+		return
+	}
+	spaces = append([]string(nil), spaces...)
+	sort.Strings(spaces)
+	r.mutex.Lock()
+	r.spaces = spaces
+	r.mutex.Unlock()
+}
+
+// Status is the status of a phase finished with the error.
+func Status(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return "succeeded"
+	case ctx.Err() != nil, errors.Is(err, context.Canceled):
+		return "aborted"
+	default:
+		return "failed"
+	}
+}
+
+func (r *Runner) env(h config.Hook, status string, err error) [][2]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	env := [][2]string{
+		{"BR_COMMAND", r.command},
+		{"BR_HOOK", h.When},
+		{"BR_PHASE", h.Phase},
+		{"BR_BACKUP_NAME", r.backupName},
+		{"BR_SPACES", strings.Join(r.spaces, ",")},
+		{"BR_STATUS", status},
+	}
+	if err != nil {
+		// a remote hook reads every value as a line
+		env = append(env, [2]string{"BR_ERROR", strings.ReplaceAll(redact.Text(err.Error()), "\n", " ")})
+	}
+	return env
+}
+
+func (r *Runner) run(ctx context.Context, h config.Hook, env [][2]string) error {
+	// the command is not logged, it may carry a token
+	r.log.Info("run hook", zap.String("hook", h.When+"-"+h.Phase), zap.String("host", h.Host))
+	if h.Host != "" {
+		user := h.User
+		if user == "" {
+			user = r.user
+		}
+		var vars []string
+		for _, kv := range env {
+			vars = append(vars, kv[0]+"="+kv[1])
+		}
+		out, err := r.ssh.ExecSecretCommand(ctx, h.Host, user, h.Command, vars)
+		if out = strings.TrimSpace(out); out != "" {
+			r.log.Info("hook output", zap.String("hook", h.When+"-"+h.Phase), zap.String("output", out))
+		}
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Env = os.Environ()
+	for _, kv := range env {
+		cmd.Env = append(cmd.Env, kv[0]+"="+kv[1])
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if s := strings.TrimSpace(string(out)); s != "" {
+		r.log.Info("hook output", zap.String("hook", h.When+"-"+h.Phase), zap.String("output", s))
+	}
+	if err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+		return err
+	}
+	return nil
+}
+
+// Pre runs the pre hooks of the phase, the first failed one stops the others and
+// its error is returned, which aborts the run.
+func (r *Runner) Pre(ctx context.Context, phase string) error {
+	if r == nil {
+		return nil
+	}
+	for _, h := range r.hooks {
+		if h.When != "pre" || h.Phase != phase {
+			continue
+		}
+		if err := r.run(ctx, h, r.env(h, "running", nil)); err != nil {
+			err = newError(h, err)
+			r.log.Error("pre hook failed", zap.String("phase", phase), zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// Post runs the post hooks of the phase finished with the error. They are run even if the
+// run is aborted, e.g. to resume the writers paused by a pre hook, and their failures are only logged.
+func (r *Runner) Post(ctx context.Context, phase string, err error) {
+	if r == nil {
+		return
+	}
+	status := Status(ctx, err)
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	for _, h := range r.hooks {
+		if h.When != "post" || h.Phase != phase {
+			continue
+		}
+		if e := r.run(ctx, h, r.env(h, status, err)); e != nil {
+			r.log.Error("post hook failed", zap.String("phase", phase), zap.Error(newError(h, e)))
+		}
+	}
+}
+
+// Run runs f between the pre and the post hooks of the phase, f is not run if a pre hook fails.
+// The post hooks are run once the pre hooks are run, even if they failed.
+func (r *Runner) Run(ctx context.Context, phase string, f func() error) error {
+	err := r.Pre(ctx, phase)
+	if err == nil {
+		err = f()
+	}
+	r.Post(ctx, phase, err)
+	return err
+}
@@ -0,0 +1,112 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/redact"
+	"github.com/monadbobo/br/pkg/ssh"
+)
+
+var phases = []string{"backup", "create_backup", "upload"}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	_, err := New("backup", []config.Hook{{When: "pre", Phase: "create_backup", Command: "ls"}}, phases, nil, "nebula", log)
+	assert.NoError(err)
+	_, err = New("backup", []config.Hook{{When: "pre", Phase: "download", Command: "ls"}}, phases, nil, "nebula", log)
+	assert.Error(err)
+	_, err = New("backup", []config.Hook{{When: "during", Phase: "backup", Command: "ls"}}, phases, nil, "nebula", log)
+	assert.Error(err)
+}
+
+func TestRun(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-hook")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	record := `echo "$BR_COMMAND $BR_HOOK $BR_PHASE $BR_BACKUP_NAME $BR_SPACES $BR_STATUS $BR_ERROR" >> ` + out
+	r, err := New("backup", []config.Hook{
+		{When: "pre", Phase: "create_backup", Command: record},
+		{When: "post", Phase: "create_backup", Command: record},
+		{When: "pre", Phase: "upload", Command: "echo paused >&2; exit 3"},
+		{When: "pre", Phase: "upload", Command: "echo never >> " + out},
+		{When: "post", Phase: "upload", Command: record},
+		{When: "post", Phase: "backup", Command: "exit 1"},
+	}, phases, nil, "nebula", log)
+	assert.NoError(err)
+	r.SetSpaces([]string{"nba", "basketball"})
+
+	ctx := context.Background()
+	err = r.Run(ctx, "create_backup", func() error {
+		r.SetBackupName("BACKUP_2020_11_10_10_00_00")
+		return nil
+	})
+	assert.NoError(err)
+
+	ran := false
+	uploadErr := r.Run(ctx, "upload", func() error {
+		ran = true
+		return nil
+	})
+	assert.False(ran)
+	var hookErr *Error
+	if assert.True(errors.As(uploadErr, &hookErr)) {
+		assert.Equal("upload", hookErr.Hook.Phase)
+		assert.Contains(uploadErr.Error(), "exit status 3: paused")
+	}
+
+	// a failed post hook is only logged
+	r.Post(ctx, "backup", nil)
+	// the post hooks are run even if the run is aborted
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	r.Post(canceled, "create_backup", context.Canceled)
+	// the credentials in the error are redacted
+	r.Post(ctx, "create_backup", errors.New("command \"env AWS_SECRET_ACCESS_KEY=minio123 aws s3 cp\" failed"))
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(err)
+	assert.Equal([]string{
+		"backup pre create_backup  basketball,nba running ",
+		"backup post create_backup BACKUP_2020_11_10_10_00_00 basketball,nba succeeded ",
+		"backup post upload BACKUP_2020_11_10_10_00_00 basketball,nba failed " + uploadErr.Error(),
+		"backup post create_backup BACKUP_2020_11_10_10_00_00 basketball,nba aborted context canceled",
+		`backup post create_backup BACKUP_2020_11_10_10_00_00 basketball,nba failed command "env AWS_SECRET_ACCESS_KEY=REDACTED aws s3 cp" failed`,
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+
+	// a nil runner runs nothing
+	var nilRunner *Runner
+	assert.NoError(nilRunner.Run(ctx, "upload", func() error { return nil }))
+}
+
+func TestNewError(t *testing.T) {
+	assert := assert.New(t)
+	h := config.Hook{When: "post", Phase: "upload", Host: "192.168.8.1", Command: "curl -H 'Authorization: Bearer SECRET123' http://ticket"}
+	cmdErr := &ssh.CommandError{Host: "192.168.8.1", User: "nebula", Command: h.Command, ExitCode: 7, Stderr: "connection refused"}
+
+	// the command of a failed remote hook is left out
+	err := newError(h, cmdErr)
+	assert.NotContains(err.Error(), "SECRET123")
+	assert.Equal(`post-upload hook on 192.168.8.1 failed: command "REDACTED" on nebula@192.168.8.1 exited with 7: connection refused`, err.Error())
+	var e *ssh.CommandError
+	if assert.True(errors.As(err, &e)) {
+		assert.Equal(redact.Redacted, e.Command)
+		assert.Equal(7, e.ExitCode)
+	}
+	assert.Equal(h.Command, cmdErr.Command)
+}
@@ -0,0 +1,145 @@
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// BackupInfo summarizes a backup found in the backend.
+type BackupInfo struct {
+	Name       string    `json:"name"`
+	CreateTime time.Time `json:"create_time"`
+	Spaces     []string  `json:"spaces"`
+	HostCount  int       `json:"host_count"`
+	Size       int64     `json:"size"`
+	// Complete is true if the <name>.meta file is present, it is uploaded at last.
+	Complete bool `json:"complete"`
+}
+
+type List struct {
+	config  config.ListConfig
+	backend storage.ExternalStorage
+	log     *zap.Logger
+}
+
+func NewList(cf config.ListConfig, log *zap.Logger) (*List, error) {
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	if err != nil {
+		return nil, err
+	}
+	return &List{config: cf, backend: backend, log: log}, nil
+}
+
+// ListBackups returns all the backups of the backend sorted by the create time.
+func (l *List) ListBackups() ([]*BackupInfo, error) {
+	objects, err := l.backend.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make(map[string]*BackupInfo)
+	for _, o := range objects {
+		parts := strings.SplitN(o.Path, "/", 2)
+		if len(parts) != 2 || parts[0] == storage.ReportDir {
+			// not in a backup directory
+			continue
+		}
+		name := parts[0]
+		info, ok := backups[name]
+		if !ok {
+			info = &BackupInfo{Name: name, CreateTime: o.ModTime}
+			backups[name] = info
+		}
+		info.Size += o.Size
+		if o.ModTime.Before(info.CreateTime) {
+			info.CreateTime = o.ModTime
+		}
+		if parts[1] == metafile.Name(name) {
+			info.Complete = true
+		}
+	}
+
+	var result []*BackupInfo
+	for _, info := range backups {
+		if info.Complete {
+			if err := l.readMeta(info); err != nil {
+				l.log.Warn("read backup meta failed", zap.String("backup", info.Name), zap.Error(err))
+			}
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CreateTime.Equal(result[j].CreateTime) {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].CreateTime.Before(result[j].CreateTime)
+	})
+	return result, nil
+}
+
+func (l *List) readMeta(info *BackupInfo) error {
+	m, err := metafile.Load(l.backend, info.Name)
+	if err != nil {
+		return err
+	}
+
+	hosts := make(map[string]bool)
+	for _, s := range m.GetBackupInfo() {
+		info.Spaces = append(info.Spaces, string(s.GetSpace().GetSpaceName()))
+		for _, cp := range s.GetCpDirs() {
+			hosts[fmt.Sprintf("%s:%d", cp.GetHost().GetHost(), cp.GetHost().GetPort())] = true
+		}
+	}
+	sort.Strings(info.Spaces)
+	info.HostCount = len(hosts)
+	return nil
+}
+
+// Print writes the backups as a table or as json.
+func Print(w io.Writer, backups []*BackupInfo, output string) error {
+	switch output {
+	case "json":
+		if backups == nil {
+			backups = []*BackupInfo{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(backups)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATE TIME\tSPACES\tHOSTS\tSIZE\tCOMPLETE")
+		for _, b := range backups {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%t\n", b.Name, b.CreateTime.Format("2006-01-02 15:04:05"),
+				strings.Join(b.Spaces, ","), b.HostCount, FormatSize(b.Size), b.Complete)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
+
+// FormatSize formats the bytes in a human readable way, e.g. 1.5GiB.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,112 @@
+package list
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+// writeFile writes the file of the backend and returns its size.
+func writeFile(t *testing.T, dir string, file string, content []byte, modTime time.Time) int64 {
+	p := filepath.Join(dir, file)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(content))
+}
+
+func spaceBackupInfo(name string, hosts ...string) *meta.SpaceBackupInfo {
+	info := &meta.SpaceBackupInfo{
+		Space:         &meta.SpaceDesc{SpaceName: []byte(name), VidType: meta.NewColumnTypeDef()},
+		PartitionInfo: &nebula.PartitionBackupInfo{},
+	}
+	for _, h := range hosts {
+		info.CpDirs = append(info.CpDirs, &meta.CheckpointInfo{Host: &nebula.HostAddr{Host: h, Port: 44500}, CheckpointDir: []byte("/data/cp")})
+	}
+	return info
+}
+
+func TestListBackups(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-list")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// a complete backup of two spaces on two hosts
+	created := time.Date(2020, 11, 10, 10, 0, 0, 0, time.Local)
+	name := "BACKUP_2020_11_10_10_00_00"
+	size := writeFile(t, dir, name+"/meta/__edges__.sst", []byte("abc"), created)
+	size += writeFile(t, dir, name+"/storage/192.168.8.1/1/data/000012.sst", []byte("hello"), created.Add(time.Minute))
+	var buf bytes.Buffer
+	assert.NoError(metafile.Write(&buf, &meta.BackupMeta{BackupName: name, BackupInfo: map[nebula.GraphSpaceID]*meta.SpaceBackupInfo{
+		1: spaceBackupInfo("nba", "192.168.8.1", "192.168.8.2"),
+		2: spaceBackupInfo("basketball", "192.168.8.1"),
+	}}))
+	size += writeFile(t, dir, name+"/"+metafile.Name(name), buf.Bytes(), created.Add(2*time.Minute))
+
+	// an incomplete backup created later without the meta file, a file out of any backup
+	// and the report of a failed backup
+	incomplete := "BACKUP_2020_11_09_10_00_00"
+	writeFile(t, dir, incomplete+"/meta/__edges__.sst", []byte("abcd"), created.Add(time.Hour))
+	writeFile(t, dir, "README", []byte("backups"), created)
+	writeFile(t, dir, "reports/BACKUP_2020_11_08_10_00_00.json", []byte("{}"), created)
+
+	l, err := NewList(config.ListConfig{BackendUrl: "local://" + dir}, log)
+	assert.NoError(err)
+	backups, err := l.ListBackups()
+	assert.NoError(err)
+	assert.Equal([]*BackupInfo{
+		{Name: name, CreateTime: created, Spaces: []string{"basketball", "nba"}, HostCount: 2, Size: size, Complete: true},
+		{Name: incomplete, CreateTime: created.Add(time.Hour), Size: 4},
+	}, backups)
+
+	buf.Reset()
+	assert.NoError(Print(&buf, backups, "table"))
+	assert.Equal(int64(359), size)
+	assert.Equal("NAME                        CREATE TIME          SPACES          HOSTS  SIZE  COMPLETE\n"+
+		"BACKUP_2020_11_10_10_00_00  2020-11-10 10:00:00  basketball,nba  2      359B  true\n"+
+		"BACKUP_2020_11_09_10_00_00  2020-11-10 11:00:00                  0      4B    false\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(Print(&buf, backups, "json"))
+	var decoded []*BackupInfo
+	assert.NoError(json.Unmarshal(buf.Bytes(), &decoded))
+	if assert.Len(decoded, 2) {
+		assert.Equal(name, decoded[0].Name)
+		assert.True(decoded[0].CreateTime.Equal(created))
+		assert.Equal(size, decoded[0].Size)
+		assert.False(decoded[1].Complete)
+	}
+
+	// an empty list is still a json array
+	buf.Reset()
+	assert.NoError(Print(&buf, nil, "json"))
+	assert.Equal("[]\n", buf.String())
+	assert.Error(Print(&buf, backups, "yaml"))
+}
+
+func TestFormatSize(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("512B", FormatSize(512))
+	assert.Equal("1.5KiB", FormatSize(1536))
+	assert.Equal("2.0GiB", FormatSize(2<<30))
+}
@@ -0,0 +1,160 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// Version is the version of the manifest format, bump it for incompatible changes.
+const Version = 1
+
+// File is a file of the backup. For the storage files Path is relative to the
+// checkpoint dir, e.g. data/000012.sst, for the meta files it is the file name.
+type File struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// SHA256 is empty if the backup was taken with --no-checksum
+	SHA256 string `json:"sha256,omitempty"`
+	// Backup is set if the file is not uploaded with this backup but reused from an earlier one.
+	Backup string `json:"backup,omitempty"`
+}
+
+// StorageFiles is the file list of one space on one storage host,
+// they are saved under storage/<Host>/<SpaceID> in the backend.
+type StorageFiles struct {
+	Host    string `json:"host"`
+	SpaceID string `json:"space_id"`
+	Files   []File `json:"files"`
+}
+
+type Space struct {
+	SpaceID   int32  `json:"space_id"`
+	SpaceName string `json:"space_name"`
+}
+
+// Manifest records the files of a backup, it is saved as <backup name>.manifest.json
+// next to the thrift <backup name>.meta, so it can be read without thrift.
+type Manifest struct {
+	Version    int    `json:"version"`
+	BackupName string `json:"backup_name"`
+	BaseBackup string `json:"base_backup,omitempty"`
+	BrVersion  string `json:"br_version"`
+	// ClusterID is the id of the cluster read from a storage host, 0 if it is unknown
+	ClusterID int64           `json:"cluster_id,omitempty"`
+	MetaAddrs []string        `json:"meta_addrs"`
+	StartTime time.Time       `json:"start_time"`
+	EndTime   time.Time       `json:"end_time"`
+	Spaces    []Space         `json:"spaces"`
+	MetaFiles []File          `json:"meta_files"`
+	Storage   []*StorageFiles `json:"storage"`
+}
+
+func Name(backupName string) string {
+	return backupName + ".manifest.json"
+}
+
+func Read(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if m.Version > Version {
+		return nil, fmt.Errorf("unsupported manifest version %d of backup %s", m.Version, m.BackupName)
+	}
+	return m, nil
+}
+
+func Write(w io.Writer, m *Manifest) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// Load reads the manifest of a backup from the backend.
+func Load(backend storage.ExternalStorage, backupName string) (*Manifest, error) {
+	r, err := backend.Open(path.Join(backupName, Name(backupName)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return Read(r)
+}
+
+// Find returns the files of the space on the host, nil if not found.
+func (m *Manifest) Find(host string, spaceID string) *StorageFiles {
+	for _, s := range m.Storage {
+		if s.Host == host && s.SpaceID == spaceID {
+			return s
+		}
+	}
+	return nil
+}
+
+// Reused groups the reused files of a space by the backup holding them.
+func (s *StorageFiles) Reused() map[string][]string {
+	reused := make(map[string][]string)
+	for _, f := range s.Files {
+		if f.Backup != "" {
+			reused[f.Backup] = append(reused[f.Backup], f.Path)
+		}
+	}
+	return reused
+}
+
+// References reports whether the backup reuses files of the given backup.
+func (m *Manifest) References(backupName string) bool {
+	if m.BaseBackup == backupName {
+		return true
+	}
+	for _, s := range m.Storage {
+		for _, f := range s.Files {
+			if f.Backup == backupName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseFileList parses the output of FileListCommand.
+func ParseFileList(out string) ([]File, error) {
+	var files []File
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected file list line: %q", line)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		f := File{Path: fields[2], Size: size}
+		if fields[1] != "-" {
+			f.SHA256 = fields[1]
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// FileListCommand returns the shell command printing "size sha256 path" of
+// every file under the paths, it is run on the meta and storage hosts. Computing
+// the sha256 reads every file once more, so it is printed as - unless checksum is set.
+func FileListCommand(checksum bool, paths ...string) string {
+	if !checksum {
+		return "find " + strings.Join(paths, " ") + ` -type f -printf '%s - %p\n'`
+	}
+	return "find " + strings.Join(paths, " ") + " -type f | while read f; do " +
+		`echo "$(stat -c %s "$f") $(sha256sum "$f" | cut -d ' ' -f 1) $f"; done`
+}
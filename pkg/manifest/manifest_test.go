@@ -0,0 +1,66 @@
+package manifest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileList(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "br")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "data"), 0755))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "wal", "1"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "data", "000012.sst"), []byte("hello"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "wal", "1", "0000001.wal"), []byte{}, 0644))
+
+	cmd := exec.Command("sh", "-c", "cd "+dir+" && "+FileListCommand(true, "data", "wal"))
+	out, err := cmd.Output()
+	assert.NoError(err)
+
+	files, err := ParseFileList(string(out))
+	assert.NoError(err)
+	assert.ElementsMatch([]File{
+		{Path: "data/000012.sst", Size: 5, SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{Path: "wal/1/0000001.wal", Size: 0, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}, files)
+
+	// the checksums are opt-in
+	out, err = exec.Command("sh", "-c", "cd "+dir+" && "+FileListCommand(false, "data", "wal")).Output()
+	assert.NoError(err)
+	files, err = ParseFileList(string(out))
+	assert.NoError(err)
+	assert.ElementsMatch([]File{
+		{Path: "data/000012.sst", Size: 5},
+		{Path: "wal/1/0000001.wal", Size: 0},
+	}, files)
+
+	_, err = ParseFileList("12 abc\n")
+	assert.Error(err)
+}
+
+func TestManifestVersion(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	m := &Manifest{Version: Version, BackupName: "BACKUP_1", BaseBackup: "BACKUP_0",
+		Storage: []*StorageFiles{{Host: "192.168.8.1", SpaceID: "1", Files: []File{{Path: "data/000012.sst", Backup: "BACKUP_0"}}}}}
+	assert.NoError(Write(&buf, m))
+
+	r, err := Read(&buf)
+	assert.NoError(err)
+	assert.Equal(m.BackupName, r.BackupName)
+	assert.True(r.References("BACKUP_0"))
+	assert.False(r.References("BACKUP_2"))
+	assert.Equal(map[string][]string{"BACKUP_0": {"data/000012.sst"}}, r.Find("192.168.8.1", "1").Reused())
+
+	_, err = Read(bytes.NewBufferString(`{"version": 100}`))
+	assert.Error(err)
+}
@@ -0,0 +1,353 @@
+package metaclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/facebook/fbthrift/thrift/lib/go/thrift"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+var ErrLeaderNotFound = errors.New("not found leader")
+
+// CodeError is returned when metad answers a request with an error code.
+type CodeError struct {
+	Op   string
+	Code meta.ErrorCode
+}
+
+func (e *CodeError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Op, e.Code.String())
+}
+
+// SentError is returned when a request which is not idempotent fails after it may have
+// been sent, e.g. the response timed out. It is not sent again, metad may have done it.
+type SentError struct {
+	Op   string
+	Addr string
+	Err  error
+}
+
+func (e *SentError) Error() string {
+	return fmt.Sprintf("%s to %s failed after the request may have been sent, it is not retried: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *SentError) Unwrap() error {
+	return e.Err
+}
+
+// Interface is the meta service requests br sends, Client implements it.
+type Interface interface {
+	Open(ctx context.Context) error
+	Close() error
+	Addr() string
+	CreateBackup(ctx context.Context, req *meta.CreateBackupReq) (*meta.CreateBackupResp, error)
+	ListSpaces(ctx context.Context) ([]*meta.IdName, error)
+	ListHosts(ctx context.Context, role meta.HostRole) ([]*meta.HostItem, error)
+	ListSnapshots(ctx context.Context) ([]*meta.Snapshot, error)
+	DropSnapshot(ctx context.Context, name string) error
+	RestoreMeta(ctx context.Context, req *meta.RestoreMetaReq) error
+}
+
+// Client talks to the leader of the meta service, it connects to the
+// first reachable address and follows E_LEADER_CHANGED to the leader.
+type Client struct {
+	addrs  []string
+	config config.MetaClientConfig
+	addr   string
+	client *meta.MetaServiceClient
+	log    *zap.Logger
+}
+
+// withDefaults fills the options not set.
+func withDefaults(cf config.MetaClientConfig) config.MetaClientConfig {
+	if cf.ConnectTimeout <= 0 {
+		cf.ConnectTimeout = 10 * time.Second
+	}
+	if cf.Timeout <= 0 {
+		cf.Timeout = 120 * time.Second
+	}
+	if cf.Transport == "" {
+		cf.Transport = "buffered"
+	}
+	if cf.Protocol == "" {
+		cf.Protocol = "binary"
+	}
+	if cf.RetryTimes <= 0 {
+		cf.RetryTimes = 5
+	}
+	if cf.RetryDelay <= 0 {
+		cf.RetryDelay = time.Second
+	}
+	if cf.MaxRetryDelay <= 0 {
+		cf.MaxRetryDelay = 8 * time.Second
+	}
+	return cf
+}
+
+func New(addrs []string, cf config.MetaClientConfig, log *zap.Logger) (*Client, error) {
+	cf = withDefaults(cf)
+	if cf.Transport != "buffered" && cf.Transport != "framed" {
+		return nil, fmt.Errorf("unknown meta transport %s, buffered or framed", cf.Transport)
+	}
+	if cf.Protocol != "binary" && cf.Protocol != "compact" {
+		return nil, fmt.Errorf("unknown meta protocol %s, binary or compact", cf.Protocol)
+	}
+	return &Client{addrs: addrs, config: cf, log: log}, nil
+}
+
+func HostAddrString(host *nebula.HostAddr) string {
+	return net.JoinHostPort(host.GetHost(), strconv.Itoa(int(host.GetPort())))
+}
+
+// Addr is the address of the metad connected, the leader after a request.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+func (c *Client) connect(addr string) error {
+	c.Close()
+
+	conn, err := net.DialTimeout("tcp", addr, c.config.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+	sock, err := thrift.NewSocket(thrift.SocketConn(conn), thrift.SocketTimeout(c.config.Timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	var transport thrift.Transport
+	if c.config.Transport == "framed" {
+		transport = thrift.NewFramedTransport(sock)
+	} else {
+		transport = thrift.NewBufferedTransport(sock, 128<<10)
+	}
+
+	var pf thrift.ProtocolFactory
+	if c.config.Protocol == "compact" {
+		pf = thrift.NewCompactProtocolFactory()
+	} else {
+		pf = thrift.NewBinaryProtocolFactoryDefault()
+	}
+	c.addr = addr
+	c.client = meta.NewMetaServiceClientFactory(transport, pf)
+	return nil
+}
+
+func (c *Client) Close() error {
+	if c.client != nil {
+		err := c.client.Transport.Close()
+		c.client = nil
+		return err
+	}
+	return nil
+}
+
+func (c *Client) wait(ctx context.Context, i int) error {
+	delay := c.config.RetryDelay << uint(i)
+	if delay > c.config.MaxRetryDelay || delay <= 0 {
+		delay = c.config.MaxRetryDelay
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Open connects to the first reachable address, all the addresses are tried
+// again with backoff if none of them is reachable.
+func (c *Client) Open(ctx context.Context) error {
+	var err error
+	for i := 0; i < c.config.RetryTimes; i++ {
+		for _, addr := range c.addrs {
+			if err = c.connect(addr); err == nil {
+				return nil
+			}
+			c.log.Warn("connect meta failed", zap.String("addr", addr), zap.Error(err))
+		}
+		if i+1 < c.config.RetryTimes {
+			if e := c.wait(ctx, i); e != nil {
+				return e
+			}
+		}
+	}
+	return err
+}
+
+// call sends the request with f until it succeeds. The client reconnects when the
+// request fails, and follows the leader when the metad is not the leader.
+// A request which is not idempotent is sent on a new connection and only retried
+// if the connection fails or the metad is not the leader, a failure after it may
+// have been sent is returned as a SentError.
+func (c *Client) call(ctx context.Context, op string, idempotent bool, f func(*meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error)) error {
+	var lastErr error
+	retry := 0
+	for i := 0; i < c.config.RetryTimes; i++ {
+		if lastErr != nil {
+			if err := c.wait(ctx, retry); err != nil {
+				return err
+			}
+			retry++
+		}
+		lastErr = nil
+
+		if c.client == nil {
+			if err := c.Open(ctx); err != nil {
+				return err
+			}
+		} else if !idempotent {
+			// a connection closed by metad can't be told from a lost response
+			if err := c.connect(c.addr); err != nil {
+				c.log.Warn("connect meta failed", zap.String("addr", c.addr), zap.Error(err))
+				lastErr = err
+				continue
+			}
+		}
+
+		code, leader, err := f(c.client)
+		if err != nil && !idempotent {
+			c.log.Error("meta request failed after it may have been sent", zap.String("op", op), zap.String("addr", c.addr), zap.Error(err))
+			c.Close()
+			return &SentError{Op: op, Addr: c.addr, Err: err}
+		}
+		if err != nil {
+			c.log.Warn("meta request failed, retry", zap.String("op", op), zap.String("addr", c.addr), zap.Error(err))
+			c.Close()
+			lastErr = err
+			continue
+		}
+
+		switch code {
+		case meta.ErrorCode_SUCCEEDED:
+			return nil
+		case meta.ErrorCode_E_LEADER_CHANGED:
+			if leader == nil || leader.GetHost() == "" {
+				// in election, ask again later
+				c.log.Warn("meta leader not found, retry", zap.String("op", op), zap.String("addr", c.addr))
+				c.Close()
+				lastErr = ErrLeaderNotFound
+				continue
+			}
+			addr := HostAddrString(leader)
+			c.log.Info("meta leader changed", zap.String("op", op), zap.String("from", c.addr), zap.String("to", addr))
+			if err := c.connect(addr); err != nil {
+				c.log.Warn("connect meta leader failed", zap.String("addr", addr), zap.Error(err))
+				lastErr = err
+			}
+		default:
+			return &CodeError{Op: op, Code: code}
+		}
+	}
+	if lastErr == nil {
+		lastErr = ErrLeaderNotFound
+	}
+	return lastErr
+}
+
+func (c *Client) CreateBackup(ctx context.Context, req *meta.CreateBackupReq) (*meta.CreateBackupResp, error) {
+	var resp *meta.CreateBackupResp
+	err := c.call(ctx, "create backup", false, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		var err error
+		resp, err = client.CreateBackup(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), resp.GetLeader(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) ListSpaces(ctx context.Context) ([]*meta.IdName, error) {
+	var resp *meta.ListSpacesResp
+	err := c.call(ctx, "list spaces", true, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		var err error
+		resp, err = client.ListSpaces(meta.NewListSpacesReq())
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), resp.GetLeader(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetSpaces(), nil
+}
+
+func (c *Client) ListHosts(ctx context.Context, role meta.HostRole) ([]*meta.HostItem, error) {
+	req := meta.NewListHostsReq()
+	req.Role = &role
+	var resp *meta.ListHostsResp
+	err := c.call(ctx, "list hosts", true, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		var err error
+		resp, err = client.ListHosts(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), resp.GetLeader(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetHosts(), nil
+}
+
+func (c *Client) ListSnapshots(ctx context.Context) ([]*meta.Snapshot, error) {
+	var resp *meta.ListSnapshotsResp
+	err := c.call(ctx, "list snapshots", true, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		var err error
+		resp, err = client.ListSnapshots(meta.NewListSnapshotsReq())
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), resp.GetLeader(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetSnapshots(), nil
+}
+
+// DropSnapshot drops the snapshot, a snapshot not found is already dropped.
+func (c *Client) DropSnapshot(ctx context.Context, name string) error {
+	req := meta.NewDropSnapshotReq()
+	req.Name = []byte(name)
+	err := c.call(ctx, "drop snapshot", true, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		resp, err := client.DropSnapshot(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), resp.GetLeader(), nil
+	})
+	if e, ok := err.(*CodeError); ok && e.Code == meta.ErrorCode_E_NOT_FOUND {
+		c.log.Info("snapshot already dropped", zap.String("snapshot", name))
+		return nil
+	}
+	return err
+}
+
+// RestoreMeta lets the metad connected ingest the restored files,
+// it is sent to every metad, so the leader is not followed.
+func (c *Client) RestoreMeta(ctx context.Context, req *meta.RestoreMetaReq) error {
+	return c.call(ctx, "restore meta", true, func(client *meta.MetaServiceClient) (meta.ErrorCode, *nebula.HostAddr, error) {
+		resp, err := client.RestoreMeta(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.GetCode(), nil, nil
+	})
+}
@@ -0,0 +1,184 @@
+package metaclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebook/fbthrift/thrift/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+// fakeMeta is a metad which is the leader or redirects to the leader.
+type fakeMeta struct {
+	meta.MetaService
+	leader *nebula.HostAddr
+	server *thrift.SimpleServer
+	addr   string
+	// the create backup requests received, the first one is answered after createDelay
+	creates     int32
+	createDelay time.Duration
+}
+
+func (m *fakeMeta) ListSpaces(req *meta.ListSpacesReq) (*meta.ListSpacesResp, error) {
+	if m.leader != nil {
+		return &meta.ListSpacesResp{Code: meta.ErrorCode_E_LEADER_CHANGED, Leader: m.leader}, nil
+	}
+	spaceID := nebula.GraphSpaceID(1)
+	space := &meta.IdName{Id: &meta.ID{SpaceID: &spaceID}, Name: []byte("nba")}
+	return &meta.ListSpacesResp{Code: meta.ErrorCode_SUCCEEDED, Leader: &nebula.HostAddr{}, Spaces: []*meta.IdName{space}}, nil
+}
+
+func (m *fakeMeta) DropSnapshot(req *meta.DropSnapshotReq) (*meta.ExecResp, error) {
+	spaceID := nebula.GraphSpaceID(0)
+	return &meta.ExecResp{Code: meta.ErrorCode_E_NOT_FOUND, Id: &meta.ID{SpaceID: &spaceID}, Leader: &nebula.HostAddr{}}, nil
+}
+
+func (m *fakeMeta) CreateBackup(req *meta.CreateBackupReq) (*meta.CreateBackupResp, error) {
+	if atomic.AddInt32(&m.creates, 1) == 1 {
+		time.Sleep(m.createDelay)
+	}
+	return &meta.CreateBackupResp{Code: meta.ErrorCode_SUCCEEDED, Leader: &nebula.HostAddr{},
+		Meta: &meta.BackupMeta{BackupName: "BACKUP_2020_11_10_10_00_00"}}, nil
+}
+
+func newFakeMeta(t *testing.T, leader *nebula.HostAddr, cf config.MetaClientConfig) *fakeMeta {
+	sock, err := thrift.NewServerSocket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sock.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMeta{leader: leader, addr: sock.Addr().String()}
+	var tf thrift.TransportFactory = thrift.NewBufferedTransportFactory(128 << 10)
+	if cf.Transport == "framed" {
+		tf = thrift.NewFramedTransportFactory(thrift.NewTransportFactory())
+	}
+	var pf thrift.ProtocolFactory = thrift.NewBinaryProtocolFactoryDefault()
+	if cf.Protocol == "compact" {
+		pf = thrift.NewCompactProtocolFactory()
+	}
+	m.server = thrift.NewSimpleServer4(meta.NewMetaServiceProcessor(m), sock, tf, pf)
+	go m.server.Serve()
+	return m
+}
+
+func hostAddr(t *testing.T, addr string) *nebula.HostAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &nebula.HostAddr{Host: host, Port: nebula.Port(p)}
+}
+
+func TestLeaderDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+
+	for _, cf := range []config.MetaClientConfig{
+		{},
+		{Transport: "framed", Protocol: "compact"},
+	} {
+		leader := newFakeMeta(t, nil, cf)
+		follower := newFakeMeta(t, hostAddr(t, leader.addr), cf)
+
+		// the first metad is down
+		down, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+		downAddr := down.Addr().String()
+		down.Close()
+
+		c, err := New([]string{downAddr, follower.addr}, cf, log)
+		assert.NoError(err)
+		spaces, err := c.ListSpaces(ctx)
+		assert.NoError(err)
+		assert.Len(spaces, 1)
+		assert.Equal(leader.addr, c.Addr())
+
+		assert.NoError(c.DropSnapshot(ctx, "BACKUP_2020_11_10_10_00_00"))
+		c.Close()
+		leader.server.Stop()
+		follower.server.Stop()
+	}
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	downAddr := down.Addr().String()
+	down.Close()
+
+	cf := config.MetaClientConfig{RetryTimes: 3, RetryDelay: 10 * time.Millisecond, MaxRetryDelay: 15 * time.Millisecond}
+	c, err := New([]string{downAddr}, cf, log)
+	assert.NoError(err)
+	start := time.Now()
+	assert.Error(c.Open(context.Background()))
+	// 10ms + 15ms
+	assert.True(time.Since(start) >= 25*time.Millisecond)
+	assert.True(time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cf.RetryDelay = time.Hour
+	c, err = New([]string{downAddr}, cf, log)
+	assert.NoError(err)
+	assert.Equal(context.Canceled, c.Open(ctx))
+
+	_, err = New(nil, config.MetaClientConfig{Transport: "http"}, log)
+	assert.Error(err)
+	_, err = New(nil, config.MetaClientConfig{Protocol: "json"}, log)
+	assert.Error(err)
+}
+
+func TestCreateBackupNotRetried(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+
+	cf := config.MetaClientConfig{Timeout: 100 * time.Millisecond, RetryDelay: 10 * time.Millisecond}
+	m := newFakeMeta(t, nil, cf)
+	defer m.server.Stop()
+	m.createDelay = 300 * time.Millisecond
+
+	c, err := New([]string{m.addr}, cf, log)
+	assert.NoError(err)
+	defer c.Close()
+	assert.NoError(c.Open(ctx))
+
+	// the response of the first request times out after metad got it
+	_, err = c.CreateBackup(ctx, meta.NewCreateBackupReq())
+	var sentErr *SentError
+	assert.True(errors.As(err, &sentErr), "%v", err)
+	time.Sleep(2 * m.createDelay)
+	assert.Equal(int32(1), atomic.LoadInt32(&m.creates))
+
+	// the idempotent requests are still retried
+	spaces, err := c.ListSpaces(ctx)
+	assert.NoError(err)
+	assert.Len(spaces, 1)
+
+	resp, err := c.CreateBackup(ctx, meta.NewCreateBackupReq())
+	assert.NoError(err)
+	assert.Equal("BACKUP_2020_11_10_10_00_00", resp.GetMeta().GetBackupName())
+	assert.Equal(int32(2), atomic.LoadInt32(&m.creates))
+}
+
+func TestHostAddrString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("192.168.8.1:9559", HostAddrString(&nebula.HostAddr{Host: "192.168.8.1", Port: 9559}))
+}
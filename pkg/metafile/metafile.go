@@ -0,0 +1,55 @@
+package metafile
+
+import (
+	"io"
+	"path"
+
+	"github.com/facebook/fbthrift/thrift/lib/go/thrift"
+
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// Read decodes the binary thrift BackupMeta saved as <backup name>.meta.
+func Read(r io.Reader) (*meta.BackupMeta, error) {
+	trans := thrift.NewStreamTransportR(r)
+	defer trans.Close()
+
+	binaryIn := thrift.NewBinaryProtocol(trans, false, true)
+	m := meta.NewBackupMeta()
+	err := m.Read(binaryIn)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Write encodes the BackupMeta in binary thrift.
+func Write(w io.Writer, m *meta.BackupMeta) error {
+	trans := thrift.NewStreamTransportW(w)
+	defer trans.Close()
+
+	binaryOut := thrift.NewBinaryProtocol(trans, false, true)
+	err := m.Write(binaryOut)
+	if err != nil {
+		return err
+	}
+	return binaryOut.Flush()
+}
+
+// Name returns the file name of the meta file of a backup.
+func Name(backupName string) string {
+	return backupName + ".meta"
+}
+
+// Load reads the meta file of a backup from the backend.
+func Load(backend storage.ExternalStorage, backupName string) (*meta.BackupMeta, error) {
+	r, err := backend.Open(path.Join(backupName, Name(backupName)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return Read(r)
+}
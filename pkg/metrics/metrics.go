@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/ssh"
+)
+
+const namespace = "br"
+
+// Metrics are the metrics of a backup or a restore run, they are served on
+// ListenAddr during the run and pushed to PushGateway when the run finishes.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	command string
+	config  config.MetricsConfig
+	// the metrics of the run, the command is the grouping label when they are pushed
+	registry *prometheus.Registry
+	// the metrics served, with the command label
+	served *prometheus.Registry
+	server *http.Server
+	addr   string
+	log    *zap.Logger
+
+	phaseDuration *prometheus.GaugeVec
+	bytes         *prometheus.GaugeVec
+	failures      *prometheus.CounterVec
+	lastSuccess   *prometheus.GaugeVec
+	lastRun       prometheus.Gauge
+	lastRunStatus prometheus.Gauge
+
+	mutex     sync.Mutex
+	phases    map[string]time.Duration
+	succeeded map[string]time.Time
+}
+
+// New creates the metrics of the command, backup or restore.
+func New(command string, cf config.MetricsConfig, log *zap.Logger) *Metrics {
+	m := &Metrics{
+		command:   command,
+		config:    cf,
+		registry:  prometheus.NewRegistry(),
+		served:    prometheus.NewRegistry(),
+		log:       log,
+		phases:    make(map[string]time.Duration),
+		succeeded: make(map[string]time.Time),
+		phaseDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "phase_duration_seconds",
+			Help:      "Duration of a phase of the last run.",
+		}, []string{"phase"}),
+		bytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "transferred_bytes",
+			Help:      "Bytes copied from or to a host by the last run.",
+		}, []string{"host"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "failures_total",
+			Help:      "Failures of the last run by phase and error class.",
+		}, []string{"phase", "class"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backup_last_success_timestamp_seconds",
+			Help:      "Time of the last successful backup of a space.",
+		}, []string{"space"}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the last run finished.",
+		}),
+		lastRunStatus: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_success",
+			Help:      "1 if the last run succeeded, 0 otherwise.",
+		}),
+	}
+	m.registry.MustRegister(m.phaseDuration, m.bytes, m.failures, m.lastRun, m.lastRunStatus)
+	prometheus.WrapRegistererWith(prometheus.Labels{"command": command}, m.served).
+		MustRegister(m.phaseDuration, m.bytes, m.failures, m.lastRun, m.lastRunStatus)
+	// the last success of the spaces are pushed per space, so they are not replaced by a run without them
+	m.served.MustRegister(m.lastSuccess)
+	return m
+}
+
+// Serve serves the metrics on ListenAddr until Close is called.
+func (m *Metrics) Serve() error {
+	if m == nil || m.config.ListenAddr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", m.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.served, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux}
+	m.addr = l.Addr().String()
+	go m.server.Serve(l)
+	m.log.Info("serve metrics", zap.String("addr", m.addr))
+	return nil
+}
+
+func (m *Metrics) Close() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.server.Shutdown(ctx)
+}
+
+// ObservePhase records the duration of the phase started at start, the phases run by
+// several goroutines take the longest one.
+func (m *Metrics) ObservePhase(phase string, start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if d > m.phases[phase] {
+		m.phases[phase] = d
+		m.phaseDuration.WithLabelValues(phase).Set(d.Seconds())
+	}
+}
+
+func (m *Metrics) SetBytes(host string, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.bytes.WithLabelValues(host).Set(float64(bytes))
+}
+
+// Class is the class of the error, used as the label of the failures.
+func Class(err error) string {
+	var hookErr *hook.Error
+	var cmdErr *ssh.CommandError
+	var codeErr *metaclient.CodeError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &hookErr):
+		return "hook"
+	case errors.As(err, &cmdErr):
+		return "remote_command"
+	case errors.As(err, &codeErr), errors.Is(err, metaclient.ErrLeaderNotFound):
+		return "meta"
+	default:
+		return "other"
+	}
+}
+
+// Failure records the failure of the phase.
+func (m *Metrics) Failure(phase string, err error) {
+	if m == nil || err == nil {
+		return
+	}
+	m.failures.WithLabelValues(phase, Class(err)).Inc()
+}
+
+// BackupSucceeded records the time of the backup of the spaces.
+func (m *Metrics) BackupSucceeded(spaces []string) {
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range spaces {
+		m.succeeded[s] = now
+		m.lastSuccess.WithLabelValues(s).Set(float64(now.UnixNano()) / 1e9)
+	}
+}
+
+// Finish records the result of the run and pushes the metrics to PushGateway, the metrics
+// of the run replace the ones of the last run, the last success of every space backed up
+// is pushed to its own group, so the other spaces are kept.
+func (m *Metrics) Finish(err error) {
+	if m == nil {
+		return
+	}
+	m.lastRun.SetToCurrentTime()
+	if err == nil {
+		m.lastRunStatus.Set(1)
+	} else {
+		m.lastRunStatus.Set(0)
+	}
+
+	if m.config.PushGateway == "" {
+		return
+	}
+	err = push.New(m.config.PushGateway, m.config.Job).Grouping("command", m.command).Gatherer(m.registry).Push()
+	if err != nil {
+		m.log.Error("push metrics failed", zap.String("gateway", m.config.PushGateway), zap.Error(err))
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for space, t := range m.succeeded {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "backup_last_success_timestamp_seconds",
+			Help:      "Time of the last successful backup of a space.",
+		})
+		g.Set(float64(t.UnixNano()) / 1e9)
+		err = push.New(m.config.PushGateway, m.config.Job).Grouping("space", space).Collector(g).Push()
+		if err != nil {
+			m.log.Error("push metrics failed", zap.String("gateway", m.config.PushGateway), zap.String("space", space), zap.Error(err))
+			return
+		}
+	}
+	m.log.Info("pushed metrics", zap.String("gateway", m.config.PushGateway))
+}
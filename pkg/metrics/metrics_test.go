@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/ssh"
+)
+
+func TestClass(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("canceled", Class(context.Canceled))
+	assert.Equal("timeout", Class(context.DeadlineExceeded))
+	assert.Equal("remote_command", Class(&ssh.CommandError{ExitCode: 1, Err: errors.New("exit status 1")}))
+	assert.Equal("canceled", Class(fmt.Errorf("upload: %w", context.Canceled)))
+	assert.Equal("meta", Class(&metaclient.CodeError{Op: "create backup", Code: meta.ErrorCode_E_NOT_FOUND}))
+	assert.Equal("meta", Class(metaclient.ErrLeaderNotFound))
+	assert.Equal("hook", Class(&hook.Error{Hook: config.Hook{When: "pre", Phase: "backup"}, Err: &ssh.CommandError{ExitCode: 1}}))
+	assert.Equal("other", Class(errors.New("oops")))
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	var mutex sync.Mutex
+	var pushed []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		pushed = append(pushed, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	m := New("backup", config.MetricsConfig{PushGateway: gateway.URL, Job: "br", ListenAddr: "127.0.0.1:0"}, log)
+	assert.NoError(m.Serve())
+	defer m.Close()
+
+	m.ObservePhase("upload_storage", time.Now().Add(-2*time.Second))
+	m.ObservePhase("upload_storage", time.Now().Add(-time.Second))
+	m.SetBytes("192.168.8.1", 1024)
+	m.Failure("upload_meta", context.Canceled)
+	m.BackupSucceeded([]string{"nba", "basketball"})
+	m.Finish(nil)
+
+	resp, err := http.Get("http://" + m.addr + "/metrics")
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		for _, line := range []string{
+			`br_phase_duration_seconds{command="backup",phase="upload_storage"} 2`,
+			`br_transferred_bytes{command="backup",host="192.168.8.1"} 1024`,
+			`br_failures_total{class="canceled",command="backup",phase="upload_meta"} 1`,
+			`br_backup_last_success_timestamp_seconds{space="nba"}`,
+			`br_last_run_success{command="backup"} 1`,
+		} {
+			assert.Contains(string(body), line)
+		}
+	}
+
+	sort.Strings(pushed)
+	assert.Equal([]string{
+		"PUT /metrics/job/br/command/backup",
+		"PUT /metrics/job/br/space/basketball",
+		"PUT /metrics/job/br/space/nba",
+	}, pushed)
+}
@@ -0,0 +1,298 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/monadbobo/br/pkg/manifest"
+)
+
+// Task is the files of a space copied by a command on a host.
+type Task struct {
+	Host  string
+	Space string
+
+	mutex sync.Mutex
+	// the sizes of the files by their paths, nil if the files are not known
+	sizes      map[string]int64
+	copied     map[string]bool
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+	start      time.Time
+	end        time.Time
+	err        error
+}
+
+// Progress is the progress of all the tasks of a backup or a restore.
+type Progress struct {
+	mutex sync.Mutex
+	tasks []*Task
+}
+
+func New() *Progress {
+	return &Progress{}
+}
+
+// Add adds a task copying the files, the files may be nil if they are not known.
+func (p *Progress) Add(host string, space string, files []manifest.File) *Task {
+	t := &Task{Host: host, Space: space, copied: make(map[string]bool)}
+	if files != nil {
+		t.sizes = make(map[string]int64)
+		for _, f := range files {
+			t.sizes[f.Path] = f.Size
+			t.totalBytes += f.Size
+		}
+		t.totalFiles = len(t.sizes)
+	}
+
+	p.mutex.Lock()
+	p.tasks = append(p.tasks, t)
+	p.mutex.Unlock()
+	return t
+}
+
+func (t *Task) Start() {
+	t.mutex.Lock()
+	t.start = time.Now()
+	t.mutex.Unlock()
+}
+
+func (t *Task) Finish(err error) {
+	t.mutex.Lock()
+	t.end = time.Now()
+	t.err = err
+	t.mutex.Unlock()
+}
+
+// Copied marks the file of the path done, the path may be any path ending with the
+// path of the file. It returns false if the path is not a file of the task.
+func (t *Task) Copied(path string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// try the longest suffix first, e.g. /cp/data/1.sst, cp/data/1.sst, data/1.sst and 1.sst
+	for p := path; ; {
+		if size, ok := t.sizes[p]; ok {
+			if !t.copied[p] {
+				t.copied[p] = true
+				t.doneFiles++
+				t.doneBytes += size
+			}
+			return true
+		}
+		i := strings.Index(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[i+1:]
+	}
+}
+
+// stat is a snapshot of the task.
+type stat struct {
+	host       string
+	space      string
+	known      bool
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+	started    bool
+	finished   bool
+	elapsed    time.Duration
+	err        error
+}
+
+func (t *Task) stat(now time.Time) stat {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := stat{
+		host:       t.Host,
+		space:      t.Space,
+		known:      t.sizes != nil,
+		totalFiles: t.totalFiles,
+		totalBytes: t.totalBytes,
+		doneFiles:  t.doneFiles,
+		doneBytes:  t.doneBytes,
+		started:    !t.start.IsZero(),
+		finished:   !t.end.IsZero(),
+		err:        t.err,
+	}
+	if s.finished {
+		s.elapsed = t.end.Sub(t.start)
+	} else if s.started {
+		s.elapsed = now.Sub(t.start)
+	}
+	// the files are all copied if the command succeeds, even if some of them are not printed
+	if s.finished && s.err == nil {
+		s.doneFiles, s.doneBytes = s.totalFiles, s.totalBytes
+	}
+	return s
+}
+
+func (p *Progress) stats() []stat {
+	p.mutex.Lock()
+	tasks := append([]*Task(nil), p.tasks...)
+	p.mutex.Unlock()
+
+	now := time.Now()
+	var stats []stat
+	for _, t := range tasks {
+		stats = append(stats, t.stat(now))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].host != stats[j].host {
+			return stats[i].host < stats[j].host
+		}
+		return stats[i].space < stats[j].space
+	})
+	return stats
+}
+
+func speed(bytes int64, elapsed time.Duration) string {
+	if elapsed < time.Second {
+		return "-"
+	}
+	return list.FormatSize(int64(float64(bytes)/elapsed.Seconds())) + "/s"
+}
+
+// eta is the time left at the current speed.
+func eta(done int64, total int64, elapsed time.Duration) string {
+	if done == 0 || elapsed < time.Second {
+		return "-"
+	}
+	left := time.Duration(float64(total-done) / float64(done) * float64(elapsed))
+	return left.Round(time.Second).String()
+}
+
+func percent(done int64, total int64) int64 {
+	if total == 0 {
+		return 100
+	}
+	return done * 100 / total
+}
+
+// Print prints a line for every running task and a line of the total.
+func (p *Progress) Print(w io.Writer) {
+	stats := p.stats()
+	var (
+		running, finished     int
+		doneBytes, totalBytes int64
+		elapsed               time.Duration
+	)
+	for _, s := range stats {
+		doneBytes += s.doneBytes
+		totalBytes += s.totalBytes
+		if s.elapsed > elapsed {
+			elapsed = s.elapsed
+		}
+		if s.finished {
+			finished++
+			continue
+		}
+		if !s.started {
+			continue
+		}
+		running++
+		if !s.known {
+			fmt.Fprintf(w, "%s space %s: running for %s\n", s.host, s.space, s.elapsed.Round(time.Second))
+			continue
+		}
+		fmt.Fprintf(w, "%s space %s: %d/%d files, %s/%s (%d%%), %s, ETA %s\n", s.host, s.space,
+			s.doneFiles, s.totalFiles, list.FormatSize(s.doneBytes), list.FormatSize(s.totalBytes),
+			percent(s.doneBytes, s.totalBytes), speed(s.doneBytes, s.elapsed), eta(s.doneBytes, s.totalBytes, s.elapsed))
+	}
+	fmt.Fprintf(w, "total: %d/%d tasks done, %d running, %s/%s (%d%%), %s, ETA %s\n", finished, len(stats), running,
+		list.FormatSize(doneBytes), list.FormatSize(totalBytes), percent(doneBytes, totalBytes),
+		speed(doneBytes, elapsed), eta(doneBytes, totalBytes, elapsed))
+}
+
+// HostBytes returns the bytes copied by the tasks of every host.
+func (p *Progress) HostBytes() map[string]int64 {
+	bytes := make(map[string]int64)
+	for _, s := range p.stats() {
+		bytes[s.host] += s.doneBytes
+	}
+	return bytes
+}
+
+// Start prints the progress every interval until stop is called.
+func (p *Progress) Start(w io.Writer, interval time.Duration) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Print(w)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// Result is the result of a task.
+type Result struct {
+	Host  string
+	Space string
+	// Known is false if the files of the task are not known
+	Known bool
+	// Files and Bytes are the ones copied of TotalFiles files
+	TotalFiles int
+	Files      int
+	Bytes      int64
+	Duration   time.Duration
+	// Status is done, failed, running or not started
+	Status string
+	Err    error
+}
+
+// Results returns the results of all the tasks sorted by host and space.
+func (p *Progress) Results() []Result {
+	var results []Result
+	for _, s := range p.stats() {
+		status := "done"
+		switch {
+		case !s.started:
+			status = "not started"
+		case !s.finished:
+			status = "running"
+		case s.err != nil:
+			status = "failed"
+		}
+		results = append(results, Result{Host: s.host, Space: s.space, Known: s.known, TotalFiles: s.totalFiles, Files: s.doneFiles,
+			Bytes: s.doneBytes, Duration: s.elapsed, Status: status, Err: s.err})
+	}
+	return results
+}
+
+// Summary prints a table of all the tasks.
+func (p *Progress) Summary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSPACE\tFILES\tSIZE\tTIME\tSPEED\tSTATUS")
+	for _, r := range p.Results() {
+		files, size := "-", "-"
+		if r.Known {
+			files = fmt.Sprintf("%d/%d", r.Files, r.TotalFiles)
+			size = list.FormatSize(r.Bytes)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Host, r.Space, files, size,
+			r.Duration.Round(time.Second), speed(r.Bytes, r.Duration), r.Status)
+	}
+	return tw.Flush()
+}
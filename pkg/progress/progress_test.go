@@ -0,0 +1,60 @@
+package progress
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monadbobo/br/pkg/manifest"
+)
+
+func TestProgress(t *testing.T) {
+	assert := assert.New(t)
+	p := New()
+
+	space1 := p.Add("192.168.8.1", "1", []manifest.File{{Path: "data/000012.sst", Size: 3072}, {Path: "wal/1/0001.wal", Size: 1024}})
+	space2 := p.Add("192.168.8.2", "1", []manifest.File{{Path: "data/000012.sst", Size: 2048}})
+	meta := p.Add("192.168.8.1", "meta", nil)
+
+	space1.Start()
+	space1.start = space1.start.Add(-2 * time.Second)
+	assert.True(space1.Copied("/data/cp/data/000012.sst"))
+	assert.True(space1.Copied("/data/cp/data/000012.sst"))
+	assert.False(space1.Copied("/data/cp/data"))
+	assert.False(space1.Copied("'/data/cp/data/000013.sst'"))
+
+	var out bytes.Buffer
+	p.Print(&out)
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal("192.168.8.1 space 1: 1/2 files, 3.0KiB/4.0KiB (75%), 1.5KiB/s, ETA 1s", lines[0])
+	assert.True(strings.HasPrefix(lines[1], "total: 0/3 tasks done, 1 running, 3.0KiB/6.0KiB (50%)"))
+
+	space1.Finish(nil)
+	space2.Start()
+	space2.Finish(errors.New("exited with 1"))
+	meta.Start()
+	out.Reset()
+	assert.NoError(p.Summary(&out))
+	lines = strings.Split(out.String(), "\n")
+	assert.Equal(5, len(lines))
+	assert.Regexp(`^HOST\s+SPACE\s+FILES\s+SIZE\s+TIME\s+SPEED\s+STATUS$`, lines[0])
+	assert.Regexp(`^192\.168\.8\.1\s+1\s+2/2\s+4\.0KiB\s+2s\s+2\.0KiB/s\s+done$`, lines[1])
+	assert.Regexp(`^192\.168\.8\.1\s+meta\s+-\s+-\s+0s\s+-\s+running$`, lines[2])
+	assert.Regexp(`^192\.168\.8\.2\s+1\s+0/1\s+0B\s+0s\s+-\s+failed$`, lines[3])
+}
+
+func TestStart(t *testing.T) {
+	assert := assert.New(t)
+	p := New()
+	p.Add("192.168.8.1", "1", nil).Start()
+
+	var out bytes.Buffer
+	stop := p.Start(&out, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	assert.Contains(out.String(), "192.168.8.1 space 1: running for 0s\n")
+}
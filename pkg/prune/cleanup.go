@@ -0,0 +1,82 @@
+package prune
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+// backupSnapshotPrefix is the prefix of the snapshots created by CreateBackup,
+// the snapshots created with CREATE SNAPSHOT are never dropped by br.
+const backupSnapshotPrefix = "BACKUP_"
+
+// backupTimeLayout is the time in the names of the backups, in the local time of metad.
+const backupTimeLayout = "2006_01_02_15_04_05"
+
+// snapshotTime returns the time the backup snapshot was created, parsed from its name.
+func snapshotTime(name string) (time.Time, bool) {
+	t, err := time.ParseInLocation(backupTimeLayout, strings.TrimPrefix(name, backupSnapshotPrefix), time.Local)
+	return t, err == nil
+}
+
+// orphanSnapshots returns the backup snapshots older than the grace period without a dir in
+// the backend. The snapshot of an incomplete dir is kept, the backup may be still uploading.
+func orphanSnapshots(snapshots []*meta.Snapshot, backups []*list.BackupInfo, grace time.Duration, now time.Time) []string {
+	found := make(map[string]bool)
+	for _, b := range backups {
+		found[b.Name] = true
+	}
+
+	var orphans []string
+	for _, s := range snapshots {
+		name := string(s.GetName())
+		if !strings.HasPrefix(name, backupSnapshotPrefix) || found[name] {
+			continue
+		}
+		if created, ok := snapshotTime(name); !ok || now.Sub(created) < grace {
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	return orphans
+}
+
+// CleanupSnapshots drops the snapshots left by the failed backups. The snapshots younger
+// than --grace are kept for the running backups, the older ones of the backups in another
+// backend are dropped too.
+func (p *Prune) CleanupSnapshots(ctx context.Context) ([]string, error) {
+	snapshots, err := p.meta.ListSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := list.NewList(config.ListConfig{BackendUrl: p.config.BackendUrl}, p.log)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := l.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range orphanSnapshots(snapshots, backups, p.config.Grace, time.Now()) {
+		if p.config.DryRun {
+			p.log.Info("dry run, snapshot would be dropped", zap.String("snapshot", name))
+			names = append(names, name)
+			continue
+		}
+		if err := p.meta.DropSnapshot(ctx, name); err != nil {
+			return names, err
+		}
+		p.log.Info("orphan snapshot dropped", zap.String("snapshot", name))
+		names = append(names, name)
+	}
+	return names, nil
+}
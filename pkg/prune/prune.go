@@ -0,0 +1,210 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// ReferencedError is returned when deleting a backup reused by incremental backups.
+type ReferencedError struct {
+	Backup string
+	By     []string
+}
+
+func (e *ReferencedError) Error() string {
+	return fmt.Sprintf("backup %s is used by incremental backups %s", e.Backup, strings.Join(e.By, ","))
+}
+
+type Prune struct {
+	config  config.DeleteConfig
+	backend storage.ExternalStorage
+	meta    metaclient.Interface
+	log     *zap.Logger
+	// dryRunDeleted are the backups a dry run would have deleted so far
+	dryRunDeleted map[string]bool
+}
+
+func NewPrune(cf config.DeleteConfig, log *zap.Logger) (*Prune, error) {
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	if err != nil {
+		return nil, err
+	}
+	client, err := metaclient.New(cf.MetaAddrs, cf.MetaClient, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Prune{config: cf, backend: backend, meta: client, log: log, dryRunDeleted: make(map[string]bool)}, nil
+}
+
+func (p *Prune) Close() error {
+	return p.meta.Close()
+}
+
+func checkBackupName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid backup name: %q", name)
+	}
+	return nil
+}
+
+// referencedBy returns the backups which reuse files of the backup, the ones
+// deleted by the dry run are taken as deleted.
+func (p *Prune) referencedBy(name string) ([]string, error) {
+	objects, err := p.backend.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, o := range objects {
+		parts := strings.SplitN(o.Path, "/", 2)
+		if len(parts) != 2 || parts[0] == name || parts[1] != manifest.Name(parts[0]) || p.dryRunDeleted[parts[0]] {
+			continue
+		}
+		m, err := manifest.Load(p.backend, parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if m.References(name) {
+			refs = append(refs, parts[0])
+		}
+	}
+	return refs, nil
+}
+
+// DeleteBackup removes the backup from the backend and drops its snapshot,
+// a backup reused by incremental backups can't be deleted.
+func (p *Prune) DeleteBackup(ctx context.Context, name string) error {
+	if err := checkBackupName(name); err != nil {
+		return err
+	}
+
+	refs, err := p.referencedBy(name)
+	if err != nil {
+		return err
+	}
+	if len(refs) != 0 {
+		return &ReferencedError{Backup: name, By: refs}
+	}
+
+	if p.config.DryRun {
+		p.log.Info("dry run, backup would be deleted", zap.String("backup", name))
+		p.dryRunDeleted[name] = true
+		return nil
+	}
+
+	objects, err := p.backend.ListObjects(name)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		p.log.Warn("backup not found in the backend", zap.String("backup", name))
+	}
+
+	err = p.backend.Remove(name)
+	if err != nil {
+		p.log.Error("remove backup failed", zap.String("backup", name), zap.Error(err))
+		return err
+	}
+
+	// the snapshot has the name of the backup
+	err = p.meta.DropSnapshot(ctx, name)
+	if err != nil {
+		p.log.Error("drop snapshot failed", zap.String("backup", name), zap.Error(err))
+		return err
+	}
+
+	p.log.Info("backup deleted", zap.String("backup", name))
+	return nil
+}
+
+// DeleteBackups deletes the backups in order, it returns the ones deleted before an error.
+func (p *Prune) DeleteBackups(ctx context.Context) ([]string, error) {
+	var names []string
+	for _, name := range p.config.BackupNames {
+		if err := p.DeleteBackup(ctx, name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// selectExpired returns the complete backups which match neither keep rule,
+// the incomplete ones are left alone because they may be still running.
+func selectExpired(backups []*list.BackupInfo, keepLast int, keepWithin time.Duration, now time.Time) []*list.BackupInfo {
+	var complete []*list.BackupInfo
+	for _, b := range backups {
+		if b.Complete {
+			complete = append(complete, b)
+		}
+	}
+	// newest first
+	sort.SliceStable(complete, func(i, j int) bool { return complete[i].CreateTime.After(complete[j].CreateTime) })
+
+	var expired []*list.BackupInfo
+	for i, b := range complete {
+		if i < keepLast {
+			continue
+		}
+		if keepWithin > 0 && now.Sub(b.CreateTime) <= keepWithin {
+			continue
+		}
+		expired = append(expired, b)
+	}
+	return expired
+}
+
+// PruneBackups deletes the backups that are not kept by --keep-last or --keep-within.
+func (p *Prune) PruneBackups(ctx context.Context) ([]string, error) {
+	if p.config.KeepLast <= 0 && p.config.KeepWithin <= 0 {
+		return nil, errors.New("at least one of --keep-last and --keep-within is needed")
+	}
+
+	l, err := list.NewList(config.ListConfig{BackendUrl: p.config.BackendUrl}, p.log)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := l.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, b := range selectExpired(backups, p.config.KeepLast, p.config.KeepWithin, time.Now()) {
+		err := p.DeleteBackup(ctx, b.Name)
+		if _, ok := err.(*ReferencedError); ok {
+			p.log.Warn("backup is kept", zap.String("backup", b.Name), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, b.Name)
+	}
+	return names, nil
+}
+
+// ParseDuration is time.ParseDuration which also accepts days, e.g. 30d.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		var days int
+		if _, err := fmt.Sscanf(s, "%dd", &days); err != nil || fmt.Sprintf("%dd", days) != s {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,207 @@
+package prune
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/list"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+type fakeMeta struct {
+	metaclient.Interface
+	snapshots []string
+	dropped   []string
+}
+
+func (m *fakeMeta) ListSnapshots(ctx context.Context) ([]*meta.Snapshot, error) {
+	var snapshots []*meta.Snapshot
+	for _, s := range m.snapshots {
+		snapshots = append(snapshots, &meta.Snapshot{Name: []byte(s)})
+	}
+	return snapshots, nil
+}
+
+func (m *fakeMeta) DropSnapshot(ctx context.Context, name string) error {
+	m.dropped = append(m.dropped, name)
+	return nil
+}
+
+func TestSelectExpired(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	day := 24 * time.Hour
+	backups := []*list.BackupInfo{
+		{Name: "b1", CreateTime: now.Add(-40 * day), Complete: true},
+		{Name: "b2", CreateTime: now.Add(-20 * day), Complete: true},
+		{Name: "b3", CreateTime: now.Add(-10 * day), Complete: false},
+		{Name: "b4", CreateTime: now.Add(-5 * day), Complete: true},
+		{Name: "b5", CreateTime: now.Add(-1 * day), Complete: true},
+	}
+
+	names := func(bs []*list.BackupInfo) []string {
+		var n []string
+		for _, b := range bs {
+			n = append(n, b.Name)
+		}
+		return n
+	}
+
+	assert.Equal([]string{"b2", "b1"}, names(selectExpired(backups, 2, 0, now)))
+	assert.Equal([]string{"b1"}, names(selectExpired(backups, 0, 30*day, now)))
+	assert.Equal([]string{"b2", "b1"}, names(selectExpired(backups, 1, 7*day, now)))
+	assert.Empty(selectExpired(backups, 10, 0, now))
+}
+
+func TestParseDuration(t *testing.T) {
+	assert := assert.New(t)
+	d, err := ParseDuration("30d")
+	assert.NoError(err)
+	assert.Equal(30*24*time.Hour, d)
+
+	d, err = ParseDuration("12h")
+	assert.NoError(err)
+	assert.Equal(12*time.Hour, d)
+
+	_, err = ParseDuration("3xd")
+	assert.Error(err)
+	_, err = ParseDuration("d")
+	assert.Error(err)
+}
+
+func TestOrphanSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 11, 4, 10, 0, 0, 0, time.Local)
+	snapshots := []*meta.Snapshot{
+		{Name: []byte("BACKUP_2020_11_01_10_00_00")},
+		{Name: []byte("BACKUP_2020_11_02_10_00_00")},
+		{Name: []byte("BACKUP_2020_11_03_10_00_00")},
+		{Name: []byte("BACKUP_2020_11_04_09_00_00")},
+		{Name: []byte("BACKUP_UNKNOWN")},
+		{Name: []byte("SNAPSHOT_2020_11_03_11_00_00")},
+	}
+	backups := []*list.BackupInfo{
+		{Name: "BACKUP_2020_11_01_10_00_00", Complete: true},
+		{Name: "BACKUP_2020_11_02_10_00_00", Complete: false},
+	}
+
+	// the incomplete backup may be still uploading, the young snapshot may be still
+	// creating its dir and the age of a snapshot not named by its time is unknown
+	assert.Equal([]string{"BACKUP_2020_11_03_10_00_00"}, orphanSnapshots(snapshots, backups, 24*time.Hour, now))
+	assert.Equal([]string{"BACKUP_2020_11_03_10_00_00", "BACKUP_2020_11_04_09_00_00"}, orphanSnapshots(snapshots, backups, 0, now))
+}
+
+func TestCleanupSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-prune")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// the dir of the failed backup was removed by its cleanup
+	complete, running, failed := "BACKUP_2020_11_01_10_00_00", "BACKUP_2020_11_02_10_00_00", "BACKUP_2020_11_03_10_00_00"
+	assert.NoError(os.MkdirAll(filepath.Join(dir, complete), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, complete, complete+".meta"), nil, 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, running, "meta"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, running, "meta", "1.sst"), nil, 0644))
+	young := "BACKUP_" + time.Now().Format(backupTimeLayout)
+
+	cf := config.DeleteConfig{MetaAddrs: []string{"127.0.0.1:9559"}, BackendUrl: "local://" + dir, Grace: time.Hour, DryRun: true}
+	p, err := NewPrune(cf, log)
+	assert.NoError(err)
+	m := &fakeMeta{snapshots: []string{complete, running, failed, young, "SNAPSHOT_2020_11_03_10_00_00"}}
+	p.meta = m
+
+	names, err := p.CleanupSnapshots(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{failed}, names)
+	assert.Empty(m.dropped)
+
+	p.config.DryRun = false
+	names, err = p.CleanupSnapshots(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{failed}, names)
+	assert.Equal([]string{failed}, m.dropped)
+}
+
+func TestPruneDryRun(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-prune")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// BACKUP_2 is an incremental backup based on BACKUP_1, BACKUP_3 is a full backup
+	created := time.Now().Add(-time.Hour)
+	for i, b := range []struct{ name, base string }{{"BACKUP_1", ""}, {"BACKUP_2", "BACKUP_1"}, {"BACKUP_3", ""}} {
+		var buf bytes.Buffer
+		assert.NoError(manifest.Write(&buf, &manifest.Manifest{BackupName: b.name, BaseBackup: b.base}))
+		files := map[string][]byte{manifest.Name(b.name): buf.Bytes(), metafile.Name(b.name): nil}
+		assert.NoError(os.MkdirAll(filepath.Join(dir, b.name), 0755))
+		for name, data := range files {
+			file := filepath.Join(dir, b.name, name)
+			assert.NoError(ioutil.WriteFile(file, data, 0644))
+			modTime := created.Add(time.Duration(i) * time.Minute)
+			assert.NoError(os.Chtimes(file, modTime, modTime))
+		}
+	}
+
+	// the dry run deletes the base after the incremental backup as the real run
+	cf := config.DeleteConfig{MetaAddrs: []string{"127.0.0.1:9559"}, BackendUrl: "local://" + dir, KeepLast: 1, DryRun: true}
+	p, err := NewPrune(cf, log)
+	assert.NoError(err)
+	m := &fakeMeta{}
+	p.meta = m
+	names, err := p.PruneBackups(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"BACKUP_2", "BACKUP_1"}, names)
+	assert.Empty(m.dropped)
+
+	p, err = NewPrune(config.DeleteConfig{MetaAddrs: cf.MetaAddrs, BackendUrl: cf.BackendUrl, KeepLast: 1}, log)
+	assert.NoError(err)
+	p.meta = m
+	names, err = p.PruneBackups(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"BACKUP_2", "BACKUP_1"}, names)
+	assert.Equal([]string{"BACKUP_2", "BACKUP_1"}, m.dropped)
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	if assert.Len(entries, 1) {
+		assert.Equal("BACKUP_3", entries[0].Name())
+	}
+}
+
+func TestDeleteBackups(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-prune")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	assert.NoError(manifest.Write(&buf, &manifest.Manifest{BackupName: "BACKUP_2", BaseBackup: "BACKUP_1"}))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "BACKUP_2"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "BACKUP_2", manifest.Name("BACKUP_2")), buf.Bytes(), 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "BACKUP_3"), 0755))
+
+	// the backups deleted before the error are returned
+	cf := config.DeleteConfig{MetaAddrs: []string{"127.0.0.1:9559"}, BackendUrl: "local://" + dir, BackupNames: []string{"BACKUP_3", "BACKUP_1", "BACKUP_4"}}
+	p, err := NewPrune(cf, log)
+	assert.NoError(err)
+	p.meta = &fakeMeta{}
+	names, err := p.DeleteBackups(context.Background())
+	assert.Equal([]string{"BACKUP_3"}, names)
+	assert.Equal(&ReferencedError{Backup: "BACKUP_1", By: []string{"BACKUP_2"}}, err)
+}
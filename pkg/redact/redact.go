@@ -0,0 +1,85 @@
+package redact
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces the secrets.
+const Redacted = "REDACTED"
+
+var (
+	// the credentials given to the aws cli in the environment
+	awsCredential = regexp.MustCompile(`(AWS_ACCESS_KEY_ID|AWS_SECRET_ACCESS_KEY|AWS_SESSION_TOKEN)=\S+`)
+	// the secret query values of a url in a text, e.g. ?secret_key=...
+	secretQuery = regexp.MustCompile(`(?i)([?&][^=&\s]*(key|secret|password|token)[^=&\s]*)=[^&\s'"]+`)
+)
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "secret", "password", "token"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// URL redacts the password and the secret query values of a url,
+// e.g. the secret_key of a s3 backend.
+func URL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), Redacted)
+	}
+	q := u.Query()
+	changed := false
+	for name := range q {
+		if isSecret(name) {
+			q.Set(name, Redacted)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// Hook redacts the command of a hook formatted as <pre|post>-<phase>[@host]=<command>,
+// the commands often carry tokens, e.g. a curl to a ticket system.
+func Hook(s string) string {
+	if i := strings.Index(s, "="); i >= 0 {
+		return s[:i+1] + Redacted
+	}
+	return s
+}
+
+// Args redacts the urls and the hook commands in the arguments, both --flag value and --flag=value.
+func Args(args []string) []string {
+	var out []string
+	for i, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--hook="):
+			out = append(out, "--hook="+Hook(strings.TrimPrefix(arg, "--hook=")))
+		case i > 0 && args[i-1] == "--hook":
+			out = append(out, Hook(arg))
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "="):
+			j := strings.Index(arg, "=")
+			out = append(out, arg[:j+1]+URL(arg[j+1:]))
+		default:
+			out = append(out, URL(arg))
+		}
+	}
+	return out
+}
+
+// Text redacts the credentials in a command or an error, e.g. the secret query values of the urls.
+func Text(s string) string {
+	s = awsCredential.ReplaceAllString(s, "$1="+Redacted)
+	return secretQuery.ReplaceAllString(s, "$1="+Redacted)
+}
@@ -0,0 +1,188 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/progress"
+	"github.com/monadbobo/br/pkg/redact"
+	"github.com/monadbobo/br/pkg/ssh"
+	"github.com/monadbobo/br/pkg/version"
+)
+
+// Name is the file name of the report in the backup dir.
+const Name = "report.json"
+
+type Phase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// HostResult is the result of the files of a space copied on a host.
+type HostResult struct {
+	Host    string  `json:"host"`
+	Space   string  `json:"space"`
+	Files   int     `json:"files"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// CommandError is a failed command run on a host.
+type CommandError struct {
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+type Error struct {
+	Phase   string        `json:"phase"`
+	Message string        `json:"message"`
+	Command *CommandError `json:"command,omitempty"`
+}
+
+// Report is the outcome of a backup, it is stored next to the backup.
+// The secrets in the command line, the config and the commands are redacted.
+type Report struct {
+	BackupName  string              `json:"backup_name"`
+	BrVersion   string              `json:"br_version"`
+	CommandLine []string            `json:"command_line"`
+	Config      config.BackupConfig `json:"config"`
+	StartTime   time.Time           `json:"start_time"`
+	EndTime     time.Time           `json:"end_time"`
+	// Status is succeeded, failed or aborted
+	Status string       `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	Phases []Phase      `json:"phases"`
+	Hosts  []HostResult `json:"hosts"`
+	Errors []Error      `json:"errors"`
+
+	mutex sync.Mutex
+}
+
+// New creates the report of a backup run with the arguments and the config.
+func New(args []string, cf config.BackupConfig) *Report {
+	return &Report{
+		BrVersion:   version.Version,
+		CommandLine: redact.Args(args),
+		Config:      redactConfig(cf),
+		StartTime:   time.Now(),
+		Phases:      []Phase{},
+		Hosts:       []HostResult{},
+		Errors:      []Error{},
+	}
+}
+
+// ObservePhase records the duration of the phase started at start, the phases run by
+// several goroutines take the longest one.
+func (r *Report) ObservePhase(phase string, start time.Time) {
+	if r == nil {
+		return
+	}
+	seconds := time.Since(start).Seconds()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.Phases {
+		if r.Phases[i].Name == phase {
+			if seconds > r.Phases[i].Seconds {
+				r.Phases[i].Seconds = seconds
+			}
+			return
+		}
+	}
+	r.Phases = append(r.Phases, Phase{Name: phase, Seconds: seconds})
+}
+
+// Failure records the error of the phase with the output of the failed command,
+// the command of a failed hook is left out, it may carry a token.
+func (r *Report) Failure(phase string, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	e := Error{Phase: phase, Message: redact.Text(err.Error())}
+	var cmdErr *ssh.CommandError
+	if !errors.As(err, new(*hook.Error)) && errors.As(err, &cmdErr) {
+		e.Command = &CommandError{
+			Host:     cmdErr.Host,
+			User:     cmdErr.User,
+			Command:  redact.Text(cmdErr.Command),
+			ExitCode: cmdErr.ExitCode,
+			Stdout:   cmdErr.Stdout,
+			Stderr:   cmdErr.Stderr,
+		}
+	}
+	r.mutex.Lock()
+	r.Errors = append(r.Errors, e)
+	r.mutex.Unlock()
+}
+
+// SetHosts records the results of the copies.
+func (r *Report) SetHosts(results []progress.Result) {
+	if r == nil {
+		return
+	}
+	hosts := []HostResult{}
+	for _, res := range results {
+		h := HostResult{Host: res.Host, Space: res.Space, Files: res.Files, Bytes: res.Bytes,
+			Seconds: res.Duration.Seconds(), Status: res.Status}
+		if res.Err != nil {
+			h.Error = redact.Text(res.Err.Error())
+		}
+		hosts = append(hosts, h)
+	}
+	r.mutex.Lock()
+	r.Hosts = hosts
+	r.mutex.Unlock()
+}
+
+// Finish records the name of the backup and the result of the run.
+func (r *Report) Finish(name string, err error, aborted bool) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.BackupName = name
+	r.EndTime = time.Now()
+	switch {
+	case err == nil:
+		r.Status = "succeeded"
+	case aborted:
+		r.Status = "aborted"
+	default:
+		r.Status = "failed"
+	}
+	if err != nil {
+		r.Error = redact.Text(err.Error())
+	}
+}
+
+// redactConfig redacts the urls and the commands of the hooks.
+func redactConfig(cf config.BackupConfig) config.BackupConfig {
+	cf.BackendUrl = redact.URL(cf.BackendUrl)
+	cf.Metrics.PushGateway = redact.URL(cf.Metrics.PushGateway)
+	hooks := make([]config.Hook, len(cf.Hooks))
+	for i, h := range cf.Hooks {
+		h.Command = redact.Redacted
+		hooks[i] = h
+	}
+	cf.Hooks = hooks
+	return cf
+}
+
+func (r *Report) Write(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
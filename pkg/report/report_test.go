@@ -0,0 +1,67 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/progress"
+	"github.com/monadbobo/br/pkg/ssh"
+)
+
+func TestReport(t *testing.T) {
+	assert := assert.New(t)
+	r := New([]string{"br", "backup", "full"}, config.BackupConfig{BackendUrl: "s3://b/p?secret_key=k",
+		Hooks: []config.Hook{{When: "post", Phase: "backup", Command: "curl -H 'Authorization: Bearer t0ken' http://ticket"}}})
+	assert.Equal("s3://b/p?secret_key=REDACTED", r.Config.BackendUrl)
+	assert.Equal([]config.Hook{{When: "post", Phase: "backup", Command: "REDACTED"}}, r.Config.Hooks)
+
+	start := time.Now().Add(-2 * time.Second)
+	r.ObservePhase("upload_storage", start.Add(time.Second))
+	r.ObservePhase("upload_storage", start)
+	cmdErr := &ssh.CommandError{Host: "192.168.8.1", User: "nebula", Command: "env AWS_SECRET_ACCESS_KEY=k aws s3 cp",
+		ExitCode: 1, Stderr: "upload failed", Err: errors.New("exit status 1")}
+	r.Failure("upload_storage", fmt.Errorf("upload: %w", cmdErr))
+
+	p := progress.New()
+	task := p.Add("192.168.8.1", "1", nil)
+	task.Start()
+	task.Finish(cmdErr)
+	r.SetHosts(p.Results())
+	r.Finish("BACKUP_2020_11_10_10_00_00", cmdErr, false)
+
+	var buf bytes.Buffer
+	assert.NoError(r.Write(&buf))
+	var out Report
+	assert.NoError(json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal("failed", out.Status)
+	assert.Equal(1, len(out.Phases))
+	assert.True(out.Phases[0].Seconds >= 2)
+	if assert.Equal(1, len(out.Errors)) && assert.NotNil(out.Errors[0].Command) {
+		assert.Equal("upload_storage", out.Errors[0].Phase)
+		assert.Equal("env AWS_SECRET_ACCESS_KEY=REDACTED aws s3 cp", out.Errors[0].Command.Command)
+		assert.Equal(1, out.Errors[0].Command.ExitCode)
+		assert.Equal("upload failed", out.Errors[0].Command.Stderr)
+	}
+	if assert.Equal(1, len(out.Hosts)) {
+		assert.Equal("failed", out.Hosts[0].Status)
+		assert.NotContains(out.Hosts[0].Error, "=k ")
+	}
+	assert.NotContains(buf.String(), "secret_key=k")
+
+	// the command of a failed hook is left out
+	r = New([]string{"br", "backup", "full"}, config.BackupConfig{})
+	r.Failure("upload", &hook.Error{Hook: config.Hook{When: "pre", Phase: "upload", Host: "192.168.8.1"},
+		Err: &ssh.CommandError{Host: "192.168.8.1", User: "nebula", Command: "REDACTED", ExitCode: 7}})
+	if assert.Equal(1, len(r.Errors)) {
+		assert.Nil(r.Errors[0].Command)
+		assert.Equal(`pre-upload hook on 192.168.8.1 failed: command "REDACTED" on nebula@192.168.8.1 exited with 7`, r.Errors[0].Message)
+	}
+}
@@ -0,0 +1,114 @@
+package restore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LoadHostMapFile reads the storage host mapping from a file, every line
+// is a old=new pair, empty lines and lines starting with # are skipped.
+func LoadHostMapFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hostMap := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: invalid host mapping %q", path, n, line)
+		}
+
+		from, to := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if t, ok := hostMap[from]; ok && t != to {
+			return nil, fmt.Errorf("%s:%d: host %s is mapped to both %s and %s", path, n, from, t, to)
+		}
+		hostMap[from] = to
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hostMap, nil
+}
+
+// buildHostMap maps every backup storage host in from to exactly one host of targets.
+// The explicit entries are used first, then a host keeps its own address if it is
+// still a target, the left hosts are paired in sorted order when the count matches.
+// Any mapping that can't be decided this way is refused.
+func buildHostMap(from []string, targets []string, explicit map[string]string) (map[string]string, error) {
+	source := make(map[string]bool)
+	for _, addr := range from {
+		source[addr] = true
+	}
+
+	target := make(map[string]bool)
+	for _, addr := range targets {
+		if target[addr] {
+			return nil, fmt.Errorf("storage host %s is given more than once", addr)
+		}
+		target[addr] = true
+	}
+
+	hostMap := make(map[string]string)
+	used := make(map[string]string)
+	for f, t := range explicit {
+		if !source[f] {
+			return nil, fmt.Errorf("host %s in the host mapping is not in the backup", f)
+		}
+		if !target[t] {
+			return nil, fmt.Errorf("host %s in the host mapping is not in the storage hosts", t)
+		}
+		if u, ok := used[t]; ok {
+			return nil, fmt.Errorf("both %s and %s are mapped to %s", u, f, t)
+		}
+		hostMap[f] = t
+		used[t] = f
+	}
+
+	var left []string
+	for _, addr := range from {
+		if _, ok := hostMap[addr]; ok {
+			continue
+		}
+		if _, ok := used[addr]; target[addr] && !ok {
+			hostMap[addr] = addr
+			used[addr] = addr
+			continue
+		}
+		left = append(left, addr)
+	}
+
+	var free []string
+	for _, addr := range targets {
+		if _, ok := used[addr]; !ok {
+			free = append(free, addr)
+		}
+	}
+
+	if len(left) == 0 {
+		return hostMap, nil
+	}
+	if len(left) != len(free) {
+		return nil, fmt.Errorf("ambiguous host mapping, %d backup hosts %v left for %d storage hosts %v, use --host-map to map them",
+			len(left), left, len(free), free)
+	}
+
+	sort.Strings(left)
+	sort.Strings(free)
+	for i, addr := range left {
+		hostMap[addr] = free[i]
+	}
+	return hostMap, nil
+}
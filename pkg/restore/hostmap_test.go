@@ -0,0 +1,75 @@
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildHostMap(t *testing.T) {
+	assert := assert.New(t)
+	from := []string{"192.168.8.3:44500", "192.168.8.1:44500", "192.168.8.2:44500"}
+
+	// same cluster, every host keeps its address whatever the order
+	m, err := buildHostMap(from, []string{"192.168.8.2:44500", "192.168.8.3:44500", "192.168.8.1:44500"}, nil)
+	assert.NoError(err)
+	for _, addr := range from {
+		assert.Equal(addr, m[addr])
+	}
+
+	// new cluster, paired in sorted order
+	m, err = buildHostMap(from, []string{"10.0.0.3:44500", "10.0.0.1:44500", "10.0.0.2:44500"}, nil)
+	assert.NoError(err)
+	assert.Equal("10.0.0.1:44500", m["192.168.8.1:44500"])
+	assert.Equal("10.0.0.2:44500", m["192.168.8.2:44500"])
+	assert.Equal("10.0.0.3:44500", m["192.168.8.3:44500"])
+
+	// explicit mapping wins
+	m, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500", "10.0.0.3:44500"},
+		map[string]string{"192.168.8.1:44500": "10.0.0.3:44500"})
+	assert.NoError(err)
+	assert.Equal("10.0.0.3:44500", m["192.168.8.1:44500"])
+	assert.Equal("10.0.0.1:44500", m["192.168.8.2:44500"])
+	assert.Equal("10.0.0.2:44500", m["192.168.8.3:44500"])
+
+	// fewer storage hosts
+	_, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500"}, nil)
+	assert.Error(err)
+
+	// more storage hosts, can't tell which to use
+	_, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500", "10.0.0.3:44500", "10.0.0.4:44500"}, nil)
+	assert.Error(err)
+
+	// two hosts mapped to one
+	_, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500", "10.0.0.3:44500"},
+		map[string]string{"192.168.8.1:44500": "10.0.0.1:44500", "192.168.8.2:44500": "10.0.0.1:44500"})
+	assert.Error(err)
+
+	// unknown hosts
+	_, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500", "10.0.0.3:44500"},
+		map[string]string{"192.168.8.9:44500": "10.0.0.1:44500"})
+	assert.Error(err)
+	_, err = buildHostMap(from, []string{"10.0.0.1:44500", "10.0.0.2:44500", "10.0.0.3:44500"},
+		map[string]string{"192.168.8.1:44500": "10.0.0.9:44500"})
+	assert.Error(err)
+}
+
+func TestLoadHostMapFile(t *testing.T) {
+	assert := assert.New(t)
+	f, err := ioutil.TempFile("", "hostmap")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	f.WriteString("# old=new\n192.168.8.1:44500 = 10.0.0.1:44500\n\n192.168.8.2:44500=10.0.0.2:44500\n")
+	f.Close()
+
+	m, err := LoadHostMapFile(f.Name())
+	assert.NoError(err)
+	assert.Equal(map[string]string{"192.168.8.1:44500": "10.0.0.1:44500", "192.168.8.2:44500": "10.0.0.2:44500"}, m)
+
+	ioutil.WriteFile(f.Name(), []byte("192.168.8.1:44500\n"), 0644)
+	_, err = LoadHostMapFile(f.Name())
+	assert.Error(err)
+}
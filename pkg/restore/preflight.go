@@ -0,0 +1,148 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	metaProcess    = "nebula-metad"
+	storageProcess = "nebula-storaged"
+)
+
+// target is a data dir to restore into, the process using it must be stopped,
+// even metad with no --metastart, its data dir is written before it is started.
+type target struct {
+	ip      string
+	user    string
+	process string
+	dir     string
+}
+
+type targetState struct {
+	running  bool
+	notEmpty bool
+}
+
+// preflightCommand prints "running" if the process is running and "not empty" if the dir has any file.
+func preflightCommand(process string, dir string) string {
+	return fmt.Sprintf("if pgrep -x %s >/dev/null; then echo running; fi; if [ -n \"$(ls -A %s 2>/dev/null)\" ]; then echo not empty; fi", process, dir)
+}
+
+func parsePreflight(out string) targetState {
+	var s targetState
+	for _, line := range strings.Split(out, "\n") {
+		switch strings.TrimSpace(line) {
+		case "running":
+			s.running = true
+		case "not empty":
+			s.notEmpty = true
+		}
+	}
+	return s
+}
+
+// moveAsideCommand moves the dir to dir.suffix and leaves an empty dir to restore into.
+func moveAsideCommand(dir string, suffix string) string {
+	return fmt.Sprintf("mv %s %s.%s && mkdir -p %s", dir, dir, suffix, dir)
+}
+
+// targets returns the data dirs of every meta and storage host, a host is checked once.
+func (r *Restore) targets() []target {
+	var targets []target
+	seen := make(map[string]bool)
+	add := func(addrs []string, user string, process string, dir string) {
+		for _, addr := range addrs {
+			ip := strings.Split(addr, ":")[0]
+			if seen[process+ip] {
+				continue
+			}
+			seen[process+ip] = true
+			targets = append(targets, target{ip: ip, user: user, process: process, dir: dir})
+		}
+	}
+	add(r.config.MetaAddrs, r.config.MetaUser, metaProcess, r.config.MetaDataDir)
+	add(r.config.StorageAddrs, r.config.StorageUser, storageProcess, r.config.StorageDataDir)
+	return targets
+}
+
+// checkTargets returns the problems found on the targets and the dirs to move aside,
+// nothing is moved if there is any problem.
+func (r *Restore) checkTargets(targets []target, states []targetState) ([]string, []target) {
+	var problems []string
+	var moves []target
+	for i, t := range targets {
+		s := states[i]
+		if s.running {
+			problems = append(problems, fmt.Sprintf("%s is running on %s", t.process, t.ip))
+		}
+		if !s.notEmpty {
+			continue
+		}
+		switch {
+		case r.config.MoveAside:
+			moves = append(moves, t)
+		case r.config.Overwrite:
+			r.log.Warn("restore into non-empty dir", zap.String("host", t.ip), zap.String("dir", t.dir))
+		default:
+			problems = append(problems, fmt.Sprintf("%s on %s is not empty", t.dir, t.ip))
+		}
+	}
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return problems, nil
+	}
+	return nil, moves
+}
+
+// preflight makes sure the nebula services are stopped and the data dirs are empty before
+// anything is restored. The non-empty dirs are kept with --overwrite or moved aside with --move-aside,
+// nothing is moved unless every host passes the check.
+func (r *Restore) preflight(ctx context.Context) error {
+	targets := r.targets()
+	states := make([]targetState, len(targets))
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range targets {
+		i := i
+		g.Go(func() error {
+			t := targets[i]
+			out, err := r.ssh.ExecCommandOutput(gctx, t.ip, t.user, preflightCommand(t.process, t.dir))
+			if err != nil {
+				return err
+			}
+			states[i] = parsePreflight(out)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	problems, moves := r.checkTargets(targets, states)
+	if len(problems) != 0 {
+		return fmt.Errorf("restore preflight failed: %s; stop the services, restore with --overwrite to restore into the data dirs or --move-aside to keep them",
+			strings.Join(problems, "; "))
+	}
+
+	suffix := "br-" + time.Now().Format("20060102150405")
+	g, gctx = errgroup.WithContext(ctx)
+	for _, t := range moves {
+		t := t
+		g.Go(func() error {
+			err := r.ssh.ExecCommand(gctx, t.ip, t.user, moveAsideCommand(t.dir, suffix))
+			if err != nil {
+				return err
+			}
+			r.log.Info("moved aside data dir", zap.String("host", t.ip), zap.String("dir", t.dir), zap.String("to", t.dir+"."+suffix))
+			return nil
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,114 @@
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+)
+
+func TestPreflightCommand(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "br-restore")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	run := func(cmd string) string {
+		out, err := exec.Command("sh", "-c", cmd).Output()
+		assert.NoError(err)
+		return string(out)
+	}
+
+	// a dir not created yet is empty
+	assert.Equal(targetState{}, parsePreflight(run(preflightCommand("br-no-such-process", data))))
+	assert.NoError(os.Mkdir(data, 0755))
+	assert.Equal(targetState{}, parsePreflight(run(preflightCommand("br-no-such-process", data))))
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(data, "CURRENT"), nil, 0644))
+	assert.Equal(targetState{notEmpty: true}, parsePreflight(run(preflightCommand("br-no-such-process", data))))
+
+	run(moveAsideCommand(data, "br-1"))
+	assert.Equal(targetState{}, parsePreflight(run(preflightCommand("br-no-such-process", data))))
+	_, err = os.Stat(filepath.Join(dir, "data.br-1", "CURRENT"))
+	assert.NoError(err)
+
+	sleep := exec.Command("sleep", "10")
+	assert.NoError(sleep.Start())
+	defer sleep.Process.Kill()
+	assert.Equal(targetState{running: true}, parsePreflight(run(preflightCommand("sleep", data))))
+}
+
+func TestCheckTargets(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	cf := config.RestoreConfig{
+		MetaAddrs:      []string{"192.168.8.1:45500"},
+		StorageAddrs:   []string{"192.168.8.1:44500", "192.168.8.2:44500"},
+		MetaUser:       "nebula",
+		StorageUser:    "nebula",
+		MetaDataDir:    "/data/meta",
+		StorageDataDir: "/data/storage",
+	}
+	meta := target{ip: "192.168.8.1", user: "nebula", process: metaProcess, dir: "/data/meta"}
+	storage1 := target{ip: "192.168.8.1", user: "nebula", process: storageProcess, dir: "/data/storage"}
+	storage2 := target{ip: "192.168.8.2", user: "nebula", process: storageProcess, dir: "/data/storage"}
+
+	cases := []struct {
+		name      string
+		overwrite bool
+		moveAside bool
+		metaStart string
+		states    []targetState
+		problems  []string
+		moves     []target
+	}{
+		{name: "all stopped and empty", states: []targetState{{}, {}, {}}},
+		{
+			name:     "not empty",
+			states:   []targetState{{notEmpty: true}, {}, {notEmpty: true}},
+			problems: []string{"/data/meta on 192.168.8.1 is not empty", "/data/storage on 192.168.8.2 is not empty"},
+		},
+		{name: "overwrite", overwrite: true, states: []targetState{{notEmpty: true}, {}, {notEmpty: true}}},
+		{
+			name:      "move aside",
+			moveAside: true,
+			states:    []targetState{{notEmpty: true}, {}, {notEmpty: true}},
+			moves:     []target{meta, storage2},
+		},
+		{
+			name:     "storaged running",
+			states:   []targetState{{}, {running: true}, {}},
+			problems: []string{"nebula-storaged is running on 192.168.8.1"},
+		},
+		{
+			name:      "metad running without --metastart",
+			overwrite: true,
+			states:    []targetState{{running: true, notEmpty: true}, {}, {}},
+			problems:  []string{"nebula-metad is running on 192.168.8.1"},
+		},
+		{
+			name:      "nothing moved if any host fails",
+			moveAside: true,
+			metaStart: "/usr/local/nebula/scripts/nebula.service start metad",
+			states:    []targetState{{notEmpty: true}, {notEmpty: true}, {running: true, notEmpty: true}},
+			problems:  []string{"nebula-storaged is running on 192.168.8.2"},
+		},
+	}
+	for _, c := range cases {
+		cf.Overwrite, cf.MoveAside, cf.MetaStartCmd = c.overwrite, c.moveAside, c.metaStart
+		r := &Restore{config: cf, log: log}
+		targets := r.targets()
+		assert.Equal([]target{meta, storage1, storage2}, targets, c.name)
+		problems, moves := r.checkTargets(targets, c.states)
+		assert.Equal(c.problems, problems, c.name)
+		assert.Equal(c.moves, moves, c.name)
+	}
+}
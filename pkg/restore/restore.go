@@ -2,47 +2,98 @@ package restore
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/facebook/fbthrift/thrift/lib/go/thrift"
 	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/hook"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/metrics"
 	"github.com/monadbobo/br/pkg/nebula"
 	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/progress"
 	"github.com/monadbobo/br/pkg/ssh"
 	"github.com/monadbobo/br/pkg/storage"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
+// executor runs the commands on the hosts, an *ssh.Pool but in the tests.
+type executor interface {
+	ExecCommand(ctx context.Context, addr string, user string, cmd string) error
+	ExecCommandOutput(ctx context.Context, addr string, user string, cmd string) (string, error)
+	ExecCommandLines(ctx context.Context, addr string, user string, cmd string, env []string, input string, f func(line string)) error
+	Close() error
+}
+
 type Restore struct {
 	config       config.RestoreConfig
 	backend      storage.ExternalStorage
+	ssh          executor
 	log          *zap.Logger
 	metaFileName string
+	progress     *progress.Progress
+	metrics      *metrics.Metrics
+	hooks        *hook.Runner
+	// newMeta creates the client of the meta service at the addresses
+	newMeta func(addrs []string) (metaclient.Interface, error)
 }
 
+// Phases are the phases of a restore the hooks can be run around, restore is the whole run.
+var Phases = []string{"restore", "prepare", "preflight", "download", "start_meta", "restore_meta"}
+
 type spaceInfo struct {
 	spaceID nebula.GraphSpaceID
 	cpDir   string
 }
 
-func NewRestore(config config.RestoreConfig, log *zap.Logger) *Restore {
+func NewRestore(config config.RestoreConfig, log *zap.Logger) (*Restore, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	backend, err := storage.NewExternalStorage(config.BackendUrl, log)
 	if err != nil {
 		log.Error("new external storage failed", zap.Error(err))
-		return nil
+		return nil, err
+	}
+	// the meta clients are created at the end of the restore, check the options first
+	if _, err := metaclient.New(config.MetaAddrs, config.MetaClient, log); err != nil {
+		return nil, err
 	}
 	backend.SetBackupName(config.BackupName)
-	return &Restore{config: config, log: log, backend: backend}
+	pool := ssh.NewPool(config.SSH, log)
+	hooks, err := hook.New("restore", config.Hooks, Phases, pool, config.StorageUser, log)
+	if err != nil {
+		return nil, err
+	}
+	hooks.SetBackupName(config.BackupName)
+	newMeta := func(addrs []string) (metaclient.Interface, error) {
+		return metaclient.New(addrs, config.MetaClient, log)
+	}
+	return &Restore{config: config, log: log, backend: backend, ssh: pool, hooks: hooks, newMeta: newMeta,
+		metrics: metrics.New("restore", config.Metrics, log)}, nil
 }
 
-func (r *Restore) downloadMetaFile() error {
-	r.metaFileName = r.config.BackupName + ".meta"
+// Close closes the ssh connections to the meta and storage hosts and the metrics endpoint.
+func (r *Restore) Close() error {
+	r.metrics.Close()
+	return r.ssh.Close()
+}
+
+func (r *Restore) downloadMetaFile(ctx context.Context) error {
+	r.metaFileName = metafile.Name(r.config.BackupName)
 	cmdStr := r.backend.RestoreMetaFileCommand(r.metaFileName, "/tmp/")
-	cmd := exec.Command(cmdStr[0], cmdStr[1:]...)
+	cmd := exec.CommandContext(ctx, cmdStr[0], cmdStr[1:]...)
+	cmd.Env = append(os.Environ(), r.backend.Env()...)
 	err := cmd.Run()
 	if err != nil {
 		return err
@@ -60,32 +111,183 @@ func (r *Restore) restoreMetaFile() (*meta.BackupMeta, error) {
 
 	defer file.Close()
 
-	trans := thrift.NewStreamTransport(file, file)
+	return metafile.Read(file)
+}
 
-	binaryIn := thrift.NewBinaryProtocol(trans, false, true)
-	defer trans.Close()
-	m := meta.NewBackupMeta()
-	err = m.Read(binaryIn)
-	if err != nil {
-		return nil, err
-	}
+// copyCommand is a command downloading files with the file list as its stdin.
+type copyCommand struct {
+	cmd      string
+	fileList string
+}
 
-	return m, nil
+// copy runs the commands downloading the files of the tasks on the host one by one,
+// the progress is updated with the files printed by the commands.
+func (r *Restore) copy(ctx context.Context, host string, user string, cmds []copyCommand, tasks []*progress.Task) error {
+	for _, t := range tasks {
+		t.Start()
+	}
+	var err error
+	for _, c := range cmds {
+		err = r.ssh.ExecCommandLines(ctx, host, user, c.cmd, r.backend.Env(), c.fileList, func(line string) {
+			_, dst, ok := r.backend.CopiedFile(line)
+			if !ok {
+				return
+			}
+			for _, t := range tasks {
+				if t.Copied(dst) {
+					return
+				}
+			}
+		})
+		if err != nil {
+			break
+		}
+	}
+	for _, t := range tasks {
+		t.Finish(err)
+	}
+	return err
 }
 
-func (r *Restore) downloadMeta(g *errgroup.Group, file []string) {
+func (r *Restore) downloadMeta(ctx context.Context, g *errgroup.Group, file []string, m *manifest.Manifest) {
 	cmd := r.backend.RestoreMetaCommand(file, r.config.MetaDataDir)
+	var files []manifest.File
+	if m != nil {
+		files = m.MetaFiles
+	} else {
+		for _, f := range file {
+			files = append(files, manifest.File{Path: f})
+		}
+	}
 	for _, ip := range r.config.MetaAddrs {
 		ipAddr := strings.Split(ip, ":")
-		g.Go(func() error { return ssh.ExecCommandBySSH(ipAddr[0], r.config.MetaUser, cmd, r.log) })
+		task := r.progress.Add(ipAddr[0], "meta", files)
+		g.Go(func() error {
+			return r.copy(ctx, ipAddr[0], r.config.MetaUser, []copyCommand{{cmd: cmd}}, []*progress.Task{task})
+		})
 	}
 }
 
+// storageTasks adds a task for every space restored to the host, the paths of
+// the files are relative to the data dir, e.g. 1/data/000012.sst.
+func (r *Restore) storageTasks(m *manifest.Manifest, from string, to string, ids []string) []*progress.Task {
+	var tasks []*progress.Task
+	for _, id := range ids {
+		var files []manifest.File
+		if m != nil {
+			files = []manifest.File{}
+			if s := m.Find(from, id); s != nil {
+				for _, f := range s.Files {
+					files = append(files, manifest.File{Path: id + "/" + f.Path, Size: f.Size})
+				}
+			}
+		}
+		tasks = append(tasks, r.progress.Add(to, id, files))
+	}
+	return tasks
+}
+
 func hostaddrToString(host *nebula.HostAddr) string {
-	return host.Host + ":" + string(host.Port)
+	return metaclient.HostAddrString(host)
+}
+
+func stringToHostaddr(addr string) (*nebula.HostAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s: %v", addr, err)
+	}
+	return &nebula.HostAddr{Host: host, Port: nebula.Port(port)}, nil
+}
+
+func (r *Restore) hostMapping(info map[nebula.GraphSpaceID]*meta.SpaceBackupInfo) (map[string]string, error) {
+	explicit := make(map[string]string)
+	if r.config.HostMapFile != "" {
+		m, err := LoadHostMapFile(r.config.HostMapFile)
+		if err != nil {
+			return nil, err
+		}
+		explicit = m
+	}
+	for from, to := range r.config.HostMap {
+		if t, ok := explicit[from]; ok && t != to {
+			return nil, fmt.Errorf("host %s is mapped to both %s and %s", from, t, to)
+		}
+		explicit[from] = to
+	}
+
+	var from []string
+	seen := make(map[string]bool)
+	for _, bInfo := range info {
+		for _, dir := range bInfo.CpDirs {
+			addr := hostaddrToString(dir.Host)
+			if !seen[addr] {
+				seen[addr] = true
+				from = append(from, addr)
+			}
+		}
+	}
+
+	hostMap, err := buildHostMap(from, r.config.StorageAddrs, explicit)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(from)
+	for _, addr := range from {
+		r.log.Info("storage host mapping", zap.String("from", addr), zap.String("to", hostMap[addr]))
+	}
+	return hostMap, nil
+}
+
+// loadManifest loads the manifest of the backup, nil if the backup has none.
+func (r *Restore) loadManifest() (*manifest.Manifest, error) {
+	objects, err := r.backend.ListObjects(r.config.BackupName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range objects {
+		if path.Base(o.Path) == manifest.Name(r.config.BackupName) {
+			return manifest.Load(r.backend, r.config.BackupName)
+		}
+	}
+	return nil, nil
+}
+
+// reusedFilesCommands returns the commands which download the files
+// an incremental backup reused from the earlier backups.
+func (r *Restore) reusedFilesCommands(m *manifest.Manifest, ip string, ids []string) []copyCommand {
+	if m == nil {
+		return nil
+	}
+
+	var cmds []copyCommand
+	for _, id := range ids {
+		s := m.Find(ip, id)
+		if s == nil {
+			continue
+		}
+		reused := s.Reused()
+		var backups []string
+		for name := range reused {
+			backups = append(backups, name)
+		}
+		sort.Strings(backups)
+		for _, name := range backups {
+			cmds = append(cmds, copyCommand{
+				cmd:      r.backend.RestoreStorageFilesCommand(name, ip, id, r.config.StorageDataDir),
+				fileList: storage.FileList(reused[name]),
+			})
+		}
+	}
+	return cmds
 }
 
-func (r *Restore) downloadStorage(g *errgroup.Group, info map[nebula.GraphSpaceID]*meta.SpaceBackupInfo) {
+func (r *Restore) downloadStorage(ctx context.Context, g *errgroup.Group, info map[nebula.GraphSpaceID]*meta.SpaceBackupInfo, hostMap map[string]string, m *manifest.Manifest) {
 	idMap := make(map[string][]string)
 	for gid, bInfo := range info {
 		for _, dir := range bInfo.CpDirs {
@@ -94,20 +296,108 @@ func (r *Restore) downloadStorage(g *errgroup.Group, info map[nebula.GraphSpaceI
 		}
 	}
 
-	i := 0
 	for ip, ids := range idMap {
-		r.log.Info("download", zap.String("ip", ip))
+		r.log.Info("download", zap.String("ip", ip), zap.String("to", hostMap[ip]))
 		ipAddr := strings.Split(ip, ":")
-		cmd := r.backend.RestoreStorageCommand(ipAddr[0], ids, r.config.StorageDataDir)
-		addr := strings.Split(r.config.StorageAddrs[i], ":")
-		g.Go(func() error { return ssh.ExecCommandBySSH(addr[0], r.config.StorageUser, cmd, r.log) })
-		i++
+		cmds := []copyCommand{{cmd: r.backend.RestoreStorageCommand(ipAddr[0], ids, r.config.StorageDataDir)}}
+		cmds = append(cmds, r.reusedFilesCommands(m, ipAddr[0], ids)...)
+		addr := strings.Split(hostMap[ip], ":")
+		tasks := r.storageTasks(m, ipAddr[0], addr[0], ids)
+		g.Go(func() error { return r.copy(ctx, addr[0], r.config.StorageUser, cmds, tasks) })
+	}
+
+}
+
+// startMetaService starts metad with --metastart, without it metad is
+// started by other means, e.g. a pre-restore_meta hook.
+func (r *Restore) startMetaService(ctx context.Context) error {
+	if r.config.MetaStartCmd == "" {
+		r.log.Info("no --metastart, metad should be started by other means before restore_meta")
+		return nil
+	}
+
+	for _, ip := range r.config.MetaAddrs {
+		ipAddr := strings.Split(ip, ":")
+		err := r.ssh.ExecCommand(ctx, ipAddr[0], r.config.MetaUser, r.config.MetaStartCmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreMeta lets every metad ingest the restored sst files and
+// replace the storage hosts of the backup with the new ones.
+func (r *Restore) restoreMeta(ctx context.Context, files []string, hostMap map[string]string) error {
+	req := meta.NewRestoreMetaReq()
+	for _, f := range files {
+		req.Files = append(req.Files, []byte(r.config.MetaDataDir+"/"+f))
+	}
+	for from, to := range hostMap {
+		fromAddr, err := stringToHostaddr(from)
+		if err != nil {
+			return err
+		}
+		toAddr, err := stringToHostaddr(to)
+		if err != nil {
+			return err
+		}
+		req.Hosts = append(req.Hosts, &meta.HostPair{FromHost: fromAddr, ToHost: toAddr})
 	}
 
+	for _, addr := range r.config.MetaAddrs {
+		// the meta service may just be started, Open waits for it to be ready
+		client, err := r.newMeta([]string{addr})
+		if err != nil {
+			return err
+		}
+		err = client.RestoreMeta(ctx, req)
+		client.Close()
+		if err != nil {
+			r.log.Error("restore meta failed", zap.String("addr", addr), zap.Error(err))
+			return err
+		}
+		r.log.Info("restore meta succeeded", zap.String("addr", addr))
+	}
+
+	return nil
 }
 
-func (r *Restore) RestoreCluster() error {
-	err := r.downloadMetaFile()
+// RestoreCluster restores the backup, the remote commands are killed when ctx is done.
+func (r *Restore) RestoreCluster(ctx context.Context) (err error) {
+	// the phase running, the failure is recorded with it, the post hooks of
+	// the phase are run when the next one starts or the restore ends
+	phase, start := "restore", time.Now()
+	next := func(p string) error {
+		if phase != "restore" {
+			r.metrics.ObservePhase(phase, start)
+			r.hooks.Post(ctx, phase, nil)
+		}
+		phase, start = p, time.Now()
+		return r.hooks.Pre(ctx, phase)
+	}
+	defer func() {
+		if err != nil {
+			r.metrics.Failure(phase, err)
+			if phase != "restore" {
+				r.hooks.Post(ctx, phase, err)
+			}
+		}
+		r.metrics.Finish(err)
+		r.hooks.Post(ctx, "restore", err)
+	}()
+	if err = r.metrics.Serve(); err != nil {
+		r.log.Error("serve metrics failed", zap.Error(err))
+		return err
+	}
+	if err = r.hooks.Pre(ctx, "restore"); err != nil {
+		return err
+	}
+	if err = next("prepare"); err != nil {
+		return err
+	}
+
+	err = r.downloadMetaFile(ctx)
 	if err != nil {
 		r.log.Error("download meta file failed", zap.Error(err))
 		return err
@@ -119,18 +409,84 @@ func (r *Restore) RestoreCluster() error {
 		r.log.Error("restore meta file failed", zap.Error(err))
 		return err
 	}
+	var spaces []string
+	for _, info := range m.GetBackupInfo() {
+		spaces = append(spaces, string(info.GetSpace().GetSpaceName()))
+	}
+	r.hooks.SetSpaces(spaces)
+
+	hostMap, err := r.hostMapping(m.BackupInfo)
+	if err != nil {
+		r.log.Error("map storage hosts failed", zap.Error(err))
+		return err
+	}
+
+	man, err := r.loadManifest()
+	if err != nil {
+		r.log.Error("load manifest failed", zap.Error(err))
+		return err
+	}
+	if man != nil && man.BaseBackup != "" {
+		r.log.Info("restore incremental backup", zap.String("base", man.BaseBackup))
+	}
+
+	if err = next("preflight"); err != nil {
+		return err
+	}
+	err = r.preflight(ctx)
+	if err != nil {
+		r.log.Error("restore preflight failed", zap.Error(err))
+		return err
+	}
+
+	if err = next("download"); err != nil {
+		return err
+	}
+	r.progress = progress.New()
+	if r.config.ProgressInterval > 0 {
+		stop := r.progress.Start(os.Stderr, r.config.ProgressInterval)
+		defer stop()
+	}
 
-	g, _ := errgroup.WithContext(context.Background())
+	// the first failed download cancels the others
+	g, gctx := errgroup.WithContext(ctx)
 
-	r.downloadMeta(g, m.MetaFiles)
-	r.downloadStorage(g, m.BackupInfo)
+	r.downloadMeta(gctx, g, m.MetaFiles, man)
+	r.downloadStorage(gctx, g, m.BackupInfo, hostMap, man)
 
 	err = g.Wait()
+	r.progress.Summary(os.Stdout)
+	for host, bytes := range r.progress.HostBytes() {
+		r.metrics.SetBytes(host, bytes)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			r.log.Warn("restore aborted", zap.Error(ctx.Err()))
+		}
+		r.log.Error("restore error", zap.Error(err))
+		return err
+	}
+
+	if err = next("start_meta"); err != nil {
+		return err
+	}
+	err = r.startMetaService(ctx)
+	if err != nil {
+		r.log.Error("start meta service failed", zap.Error(err))
+		return err
+	}
+
+	if err = next("restore_meta"); err != nil {
+		return err
+	}
+	err = r.restoreMeta(ctx, m.MetaFiles, hostMap)
 	if err != nil {
-		r.log.Error("restore error")
 		return err
 	}
+	r.metrics.ObservePhase(phase, start)
+	r.hooks.Post(ctx, phase, nil)
 
+	r.log.Info("restore finished, the storage service can be started now")
 	return nil
 
 }
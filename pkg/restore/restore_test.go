@@ -0,0 +1,187 @@
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metaclient"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/progress"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// localExecutor runs the commands of every host on the local host.
+type localExecutor struct {
+	mutex sync.Mutex
+	hosts []string
+}
+
+func (e *localExecutor) run(addr string, cmd string, env []string, input string) *exec.Cmd {
+	e.mutex.Lock()
+	e.hosts = append(e.hosts, addr)
+	e.mutex.Unlock()
+	c := exec.Command("sh", "-c", cmd)
+	c.Env = append(os.Environ(), env...)
+	c.Stdin = strings.NewReader(input)
+	return c
+}
+
+func (e *localExecutor) ExecCommand(ctx context.Context, addr string, user string, cmd string) error {
+	return e.run(addr, cmd, nil, "").Run()
+}
+
+func (e *localExecutor) ExecCommandOutput(ctx context.Context, addr string, user string, cmd string) (string, error) {
+	out, err := e.run(addr, cmd, nil, "").Output()
+	return string(out), err
+}
+
+func (e *localExecutor) ExecCommandLines(ctx context.Context, addr string, user string, cmd string, env []string, input string, f func(line string)) error {
+	out, err := e.run(addr, cmd, env, input).Output()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		f(scanner.Text())
+	}
+	return err
+}
+
+func (e *localExecutor) Close() error { return nil }
+
+// fakeMeta records the requests to restore the meta.
+type fakeMeta struct {
+	metaclient.Interface
+	addr string
+	reqs map[string]*meta.RestoreMetaReq
+}
+
+func (m *fakeMeta) Close() error { return nil }
+
+func (m *fakeMeta) RestoreMeta(ctx context.Context, req *meta.RestoreMetaReq) error {
+	m.reqs[m.addr] = req
+	return nil
+}
+
+func writeFiles(t *testing.T, dir string, files ...string) {
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// every file keeps its own path to tell which backup it is downloaded from
+		if err := ioutil.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDownloadIncremental(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-restore")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// BACKUP_3 is based on BACKUP_2, which is based on BACKUP_1, it reuses
+	// 000010.sst kept by BACKUP_1 and 000012.sst kept by BACKUP_2
+	backup := dir + "/backup"
+	space := "/storage/192.168.8.1/1/"
+	writeFiles(t, backup,
+		"BACKUP_1"+space+"data/000010.sst", "BACKUP_1"+space+"data/000011.sst",
+		"BACKUP_2"+space+"data/000012.sst",
+		"BACKUP_3"+space+"data/000013.sst", "BACKUP_3"+space+"wal/1/0001.wal")
+	m := &manifest.Manifest{BackupName: "BACKUP_3", BaseBackup: "BACKUP_2", Storage: []*manifest.StorageFiles{
+		{Host: "192.168.8.1", SpaceID: "1", Files: []manifest.File{
+			{Path: "data/000010.sst", Size: 39, Backup: "BACKUP_1"},
+			{Path: "data/000012.sst", Size: 39, Backup: "BACKUP_2"},
+			{Path: "data/000013.sst", Size: 39},
+			{Path: "wal/1/0001.wal", Size: 38},
+		}},
+	}}
+
+	backend, err := storage.NewExternalStorage("local://"+backup, log)
+	assert.NoError(err)
+	backend.SetBackupName("BACKUP_3")
+	data := dir + "/data"
+	assert.NoError(os.Mkdir(data, 0755))
+	e := &localExecutor{}
+	r := &Restore{config: config.RestoreConfig{StorageDataDir: data}, backend: backend, ssh: e, progress: progress.New(), log: log}
+
+	cmds := r.reusedFilesCommands(m, "192.168.8.1", []string{"1"})
+	if assert.Len(cmds, 2) {
+		assert.Equal(backend.RestoreStorageFilesCommand("BACKUP_1", "192.168.8.1", "1", data), cmds[0].cmd)
+		assert.Equal("data/000010.sst\n", cmds[0].fileList)
+		assert.Equal(backend.RestoreStorageFilesCommand("BACKUP_2", "192.168.8.1", "1", data), cmds[1].cmd)
+		assert.Equal("data/000012.sst\n", cmds[1].fileList)
+	}
+	assert.Empty(r.reusedFilesCommands(m, "192.168.8.2", []string{"1"}))
+	assert.Empty(r.reusedFilesCommands(nil, "192.168.8.1", []string{"1"}))
+
+	info := map[nebula.GraphSpaceID]*meta.SpaceBackupInfo{
+		1: {CpDirs: []*meta.CheckpointInfo{{Host: &nebula.HostAddr{Host: "192.168.8.1", Port: 44500}}}},
+	}
+	g, gctx := errgroup.WithContext(context.Background())
+	r.downloadStorage(gctx, g, info, map[string]string{"192.168.8.1:44500": "192.168.8.3:44500"}, m)
+	assert.NoError(g.Wait())
+	assert.Equal([]string{"192.168.8.3", "192.168.8.3", "192.168.8.3"}, e.hosts)
+
+	// every file comes from the backup keeping it, the files of the bases not in the manifest are not restored
+	for _, f := range []string{"BACKUP_1" + space + "data/000010.sst", "BACKUP_2" + space + "data/000012.sst",
+		"BACKUP_3" + space + "data/000013.sst", "BACKUP_3" + space + "wal/1/0001.wal"} {
+		content, err := ioutil.ReadFile(filepath.Join(data, "1", strings.SplitN(f, space, 2)[1]))
+		assert.NoError(err)
+		assert.Equal(f, string(content))
+	}
+	_, err = os.Stat(filepath.Join(data, "1/data/000011.sst"))
+	assert.True(os.IsNotExist(err))
+
+	results := r.progress.Results()
+	if assert.Len(results, 1) {
+		assert.Equal("done", results[0].Status)
+		assert.Equal(4, results[0].TotalFiles)
+		assert.Equal(4, results[0].Files)
+	}
+}
+
+func TestRestoreMeta(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+
+	reqs := make(map[string]*meta.RestoreMetaReq)
+	cf := config.RestoreConfig{MetaAddrs: []string{"192.168.8.5:9559", "192.168.8.6:9559"}, MetaDataDir: "/data/meta"}
+	r := &Restore{config: cf, log: log, newMeta: func(addrs []string) (metaclient.Interface, error) {
+		assert.Len(addrs, 1)
+		return &fakeMeta{addr: addrs[0], reqs: reqs}, nil
+	}}
+	hostMap := map[string]string{"192.168.8.1:44500": "192.168.8.3:44500", "192.168.8.2:44500": "192.168.8.4:44501"}
+	assert.NoError(r.restoreMeta(context.Background(), []string{"__edges__.sst", "__tags__.sst"}, hostMap))
+
+	// every metad ingests the files in its data dir and replaces the hosts of the backup
+	assert.Len(reqs, 2)
+	for _, addr := range cf.MetaAddrs {
+		req := reqs[addr]
+		if !assert.NotNil(req, addr) {
+			continue
+		}
+		assert.Equal([][]byte{[]byte("/data/meta/__edges__.sst"), []byte("/data/meta/__tags__.sst")}, req.Files)
+		assert.ElementsMatch([]*meta.HostPair{
+			{FromHost: &nebula.HostAddr{Host: "192.168.8.1", Port: 44500}, ToHost: &nebula.HostAddr{Host: "192.168.8.3", Port: 44500}},
+			{FromHost: &nebula.HostAddr{Host: "192.168.8.2", Port: 44500}, ToHost: &nebula.HostAddr{Host: "192.168.8.4", Port: 44501}},
+		}, req.Hosts)
+	}
+
+	assert.Error(r.restoreMeta(context.Background(), nil, map[string]string{"192.168.8.1": "192.168.8.3:44500"}))
+}
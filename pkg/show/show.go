@@ -0,0 +1,136 @@
+package show
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+type PartitionInfo struct {
+	PartID int32 `json:"part_id"`
+	LogID  int64 `json:"log_id"`
+	TermID int64 `json:"term_id"`
+}
+
+type CheckpointInfo struct {
+	Host string `json:"host"`
+	Dir  string `json:"dir"`
+}
+
+type SpaceInfo struct {
+	SpaceID       int32            `json:"space_id"`
+	SpaceName     string           `json:"space_name"`
+	PartitionNum  int32            `json:"partition_num"`
+	ReplicaFactor int32            `json:"replica_factor"`
+	CharsetName   string           `json:"charset_name"`
+	CollateName   string           `json:"collate_name"`
+	VidType       string           `json:"vid_type"`
+	Partitions    []PartitionInfo  `json:"partitions"`
+	Checkpoints   []CheckpointInfo `json:"checkpoints"`
+}
+
+// BackupInfo is the readable form of the BackupMeta saved in <backup name>.meta.
+type BackupInfo struct {
+	BackupName string      `json:"backup_name"`
+	Spaces     []SpaceInfo `json:"spaces"`
+	MetaFiles  []string    `json:"meta_files"`
+}
+
+type Show struct {
+	config  config.ShowConfig
+	backend storage.ExternalStorage
+	log     *zap.Logger
+}
+
+func NewShow(cf config.ShowConfig, log *zap.Logger) (*Show, error) {
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Show{config: cf, backend: backend, log: log}, nil
+}
+
+func (s *Show) ShowBackup() (*BackupInfo, error) {
+	m, err := metafile.Load(s.backend, s.config.BackupName)
+	if err != nil {
+		s.log.Error("read backup meta failed", zap.String("backup", s.config.BackupName), zap.Error(err))
+		return nil, err
+	}
+	return NewBackupInfo(m), nil
+}
+
+func vidType(t *meta.ColumnTypeDef) string {
+	if t == nil {
+		return ""
+	}
+	if t.GetType() == meta.PropertyType_FIXED_STRING {
+		return fmt.Sprintf("%s(%d)", t.GetType(), t.GetTypeLength())
+	}
+	return t.GetType().String()
+}
+
+func NewBackupInfo(m *meta.BackupMeta) *BackupInfo {
+	info := &BackupInfo{BackupName: m.GetBackupName(), MetaFiles: m.GetMetaFiles()}
+	for id, b := range m.GetBackupInfo() {
+		desc := b.GetSpace()
+		space := SpaceInfo{
+			SpaceID:       int32(id),
+			SpaceName:     string(desc.GetSpaceName()),
+			PartitionNum:  desc.GetPartitionNum(),
+			ReplicaFactor: desc.GetReplicaFactor(),
+			CharsetName:   string(desc.GetCharsetName()),
+			CollateName:   string(desc.GetCollateName()),
+			VidType:       vidType(desc.GetVidType()),
+		}
+		for part, log := range b.GetPartitionInfo().GetInfo() {
+			space.Partitions = append(space.Partitions, PartitionInfo{PartID: int32(part), LogID: int64(log.GetLogID()), TermID: int64(log.GetTermID())})
+		}
+		sort.Slice(space.Partitions, func(i, j int) bool { return space.Partitions[i].PartID < space.Partitions[j].PartID })
+		for _, cp := range b.GetCpDirs() {
+			host := fmt.Sprintf("%s:%d", cp.GetHost().GetHost(), cp.GetHost().GetPort())
+			space.Checkpoints = append(space.Checkpoints, CheckpointInfo{Host: host, Dir: string(cp.GetCheckpointDir())})
+		}
+		sort.Slice(space.Checkpoints, func(i, j int) bool { return space.Checkpoints[i].Host < space.Checkpoints[j].Host })
+		info.Spaces = append(info.Spaces, space)
+	}
+	sort.Slice(info.Spaces, func(i, j int) bool { return info.Spaces[i].SpaceID < info.Spaces[j].SpaceID })
+	return info
+}
+
+// Print writes the backup as text or as json.
+func Print(w io.Writer, info *BackupInfo, output string) error {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	case "text", "":
+		fmt.Fprintf(w, "Backup: %s\n", info.BackupName)
+		for _, s := range info.Spaces {
+			fmt.Fprintf(w, "\nSpace: %s (id %d)\n", s.SpaceName, s.SpaceID)
+			fmt.Fprintf(w, "  partition_num: %d, replica_factor: %d, charset: %s, collate: %s, vid_type: %s\n",
+				s.PartitionNum, s.ReplicaFactor, s.CharsetName, s.CollateName, s.VidType)
+			fmt.Fprintf(w, "  Partitions:\n")
+			for _, p := range s.Partitions {
+				fmt.Fprintf(w, "    %d: log_id %d, term_id %d\n", p.PartID, p.LogID, p.TermID)
+			}
+			fmt.Fprintf(w, "  Checkpoints:\n")
+			for _, cp := range s.Checkpoints {
+				fmt.Fprintf(w, "    %s: %s\n", cp.Host, cp.Dir)
+			}
+		}
+		fmt.Fprintf(w, "\nMeta files: %s\n", strings.Join(info.MetaFiles, ", "))
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
@@ -0,0 +1,101 @@
+package show
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+func backupMeta() *meta.BackupMeta {
+	cp := func(host string, dir string) *meta.CheckpointInfo {
+		return &meta.CheckpointInfo{Host: &nebula.HostAddr{Host: host, Port: 44500}, CheckpointDir: []byte(dir)}
+	}
+	return &meta.BackupMeta{
+		BackupName: "BACKUP_2020_11_10_10_00_00",
+		MetaFiles:  []string{"__edges__.sst", "__tags__.sst"},
+		BackupInfo: map[nebula.GraphSpaceID]*meta.SpaceBackupInfo{
+			2: {
+				Space: &meta.SpaceDesc{SpaceName: []byte("basketball"), PartitionNum: 1, ReplicaFactor: 1,
+					CharsetName: []byte("utf8"), CollateName: []byte("utf8_bin"), VidType: &meta.ColumnTypeDef{Type: meta.PropertyType_INT64}},
+				PartitionInfo: &nebula.PartitionBackupInfo{Info: map[nebula.PartitionID]*nebula.LogInfo{1: {LogID: 3, TermID: 1}}},
+				CpDirs:        []*meta.CheckpointInfo{cp("192.168.8.1", "/data/cp2")},
+			},
+			1: {
+				Space: &meta.SpaceDesc{SpaceName: []byte("nba"), PartitionNum: 2, ReplicaFactor: 1,
+					CharsetName: []byte("utf8"), CollateName: []byte("utf8_bin"), VidType: &meta.ColumnTypeDef{Type: meta.PropertyType_FIXED_STRING, TypeLength: 8}},
+				PartitionInfo: &nebula.PartitionBackupInfo{Info: map[nebula.PartitionID]*nebula.LogInfo{2: {LogID: 20, TermID: 2}, 1: {LogID: 10, TermID: 1}}},
+				CpDirs:        []*meta.CheckpointInfo{cp("192.168.8.2", "/data/cp1"), cp("192.168.8.1", "/data/cp1")},
+			},
+		},
+	}
+}
+
+func TestNewBackupInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	// the spaces, partitions and checkpoints are sorted
+	info := NewBackupInfo(backupMeta())
+	assert.Equal(&BackupInfo{
+		BackupName: "BACKUP_2020_11_10_10_00_00",
+		MetaFiles:  []string{"__edges__.sst", "__tags__.sst"},
+		Spaces: []SpaceInfo{
+			{SpaceID: 1, SpaceName: "nba", PartitionNum: 2, ReplicaFactor: 1, CharsetName: "utf8", CollateName: "utf8_bin", VidType: "FIXED_STRING(8)",
+				Partitions:  []PartitionInfo{{PartID: 1, LogID: 10, TermID: 1}, {PartID: 2, LogID: 20, TermID: 2}},
+				Checkpoints: []CheckpointInfo{{Host: "192.168.8.1:44500", Dir: "/data/cp1"}, {Host: "192.168.8.2:44500", Dir: "/data/cp1"}}},
+			{SpaceID: 2, SpaceName: "basketball", PartitionNum: 1, ReplicaFactor: 1, CharsetName: "utf8", CollateName: "utf8_bin", VidType: "INT64",
+				Partitions:  []PartitionInfo{{PartID: 1, LogID: 3, TermID: 1}},
+				Checkpoints: []CheckpointInfo{{Host: "192.168.8.1:44500", Dir: "/data/cp2"}}},
+		},
+	}, info)
+
+	var buf bytes.Buffer
+	assert.NoError(Print(&buf, info, "json"))
+	var decoded BackupInfo
+	assert.NoError(json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(info, &decoded)
+
+	buf.Reset()
+	assert.NoError(Print(&buf, info, "text"))
+	assert.Contains(buf.String(), "Space: nba (id 1)\n  partition_num: 2, replica_factor: 1, charset: utf8, collate: utf8_bin, vid_type: FIXED_STRING(8)\n")
+	assert.Contains(buf.String(), "  Checkpoints:\n    192.168.8.1:44500: /data/cp1\n    192.168.8.2:44500: /data/cp1\n")
+	assert.Contains(buf.String(), "Meta files: __edges__.sst, __tags__.sst\n")
+	assert.Error(Print(&buf, info, "yaml"))
+}
+
+func TestShowBackup(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-show")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	name := "BACKUP_2020_11_10_10_00_00"
+	assert.NoError(os.MkdirAll(filepath.Join(dir, name), 0755))
+	f, err := os.Create(filepath.Join(dir, name, metafile.Name(name)))
+	assert.NoError(err)
+	assert.NoError(metafile.Write(f, backupMeta()))
+	f.Close()
+
+	s, err := NewShow(config.ShowConfig{BackendUrl: "local://" + dir, BackupName: name}, log)
+	assert.NoError(err)
+	info, err := s.ShowBackup()
+	assert.NoError(err)
+	assert.Equal(NewBackupInfo(backupMeta()), info)
+
+	// an incomplete backup has no meta file
+	s, err = NewShow(config.ShowConfig{BackendUrl: "local://" + dir, BackupName: "BACKUP_2020_11_09_10_00_00"}, log)
+	assert.NoError(err)
+	_, err = s.ShowBackup()
+	assert.Error(err)
+}
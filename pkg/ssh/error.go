@@ -0,0 +1,73 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxOutput is the bytes of stdout and stderr kept in a CommandError.
+const maxOutput = 4096
+
+// tailBuffer keeps the last maxOutput bytes written to it.
+type tailBuffer struct {
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > maxOutput {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-maxOutput:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "..." + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// CommandError is returned when a command run on a meta or storage host fails,
+// Stdout and Stderr are the last maxOutput bytes of the output of the command.
+type CommandError struct {
+	Host    string
+	User    string
+	Command string
+	// ExitCode is -1 if the command did not exit, e.g. the connection was lost
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+func newCommandError(host string, user string, cmd string, stdout string, stderr string, err error) *CommandError {
+	e := &CommandError{Host: host, User: user, Command: cmd, ExitCode: -1, Stdout: stdout, Stderr: stderr, Err: err}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		e.ExitCode = exitErr.ExitStatus()
+	}
+	return e
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("command %q on %s@%s", e.Command, e.User, e.Host)
+	if e.ExitCode >= 0 {
+		msg += fmt.Sprintf(" exited with %d", e.ExitCode)
+	} else {
+		msg += fmt.Sprintf(" failed: %v", e.Err)
+	}
+	if out := strings.TrimSpace(e.Stderr); out != "" {
+		msg += ": " + out
+	} else if out := strings.TrimSpace(e.Stdout); out != "" {
+		msg += ": " + out
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
@@ -1,60 +1,522 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/redact"
 )
 
-func newSshSession(addr string, user string, log *zap.Logger) (*ssh.Session, error) {
-	key, err := ioutil.ReadFile(os.Getenv("HOME") + "/.ssh/id_rsa")
+var defaultKeyFiles = []string{"id_rsa", "id_ecdsa", "id_ed25519"}
+
+// Dialer connects to the meta and storage hosts with the ssh settings of br,
+// the keys are loaded once, so a passphrase is asked only once.
+type Dialer struct {
+	config config.SSHConfig
+	log    *zap.Logger
+
+	once            sync.Once
+	initErr         error
+	auth            []ssh.AuthMethod
+	hostKeyCallback ssh.HostKeyCallback
+	// agentConn is the connection of the agent authenticating with UseAgent
+	agentConn net.Conn
+}
+
+func NewDialer(cf config.SSHConfig, log *zap.Logger) *Dialer {
+	return &Dialer{config: cf, log: log}
+}
+
+func (d *Dialer) port(addr string) int {
+	if port, ok := d.config.HostPorts[addr]; ok {
+		return port
+	}
+	if d.config.Port != 0 {
+		return d.config.Port
+	}
+	return 22
+}
+
+// readPassphrase reads the passphrase of an encrypted key from $BR_SSH_PASSPHRASE or the terminal.
+func readPassphrase(keyFile string) ([]byte, error) {
+	if p := os.Getenv("BR_SSH_PASSPHRASE"); p != "" {
+		return []byte(p), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("key %s is encrypted and there is no terminal to ask the passphrase", keyFile)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key %s: ", keyFile)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+func (d *Dialer) loadKey(keyFile string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(keyFile)
 	if err != nil {
-		log.Error("unable to read private key", zap.Error(err))
 		return nil, err
 	}
 
 	// Create the Signer for this private key.
 	signer, err := ssh.ParsePrivateKey(key)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		passphrase, err := readPassphrase(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+	return signer, err
+}
+
+// keyFiles returns the key files to load and whether they are the default ones.
+func (d *Dialer) keyFiles() ([]string, bool) {
+	if len(d.config.KeyFiles) != 0 {
+		return d.config.KeyFiles, false
+	}
+
+	var files []string
+	for _, name := range defaultKeyFiles {
+		f := filepath.Join(os.Getenv("HOME"), ".ssh", name)
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files, true
+}
+
+// dialAgent connects to the ssh agent of $SSH_AUTH_SOCK.
+func (d *Dialer) dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", sock)
+}
+
+func (d *Dialer) init() error {
+	d.once.Do(func() {
+		var signers []ssh.Signer
+		if d.config.UseAgent || d.config.ForwardAgent {
+			conn, err := d.dialAgent()
+			if err != nil {
+				d.initErr = fmt.Errorf("unable to connect ssh agent: %v", err)
+				return
+			}
+			if d.config.UseAgent {
+				d.agentConn = conn
+				d.auth = append(d.auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			} else {
+				// every forwarding connects to the agent by itself, this one only checks it is there
+				conn.Close()
+			}
+		}
+
+		files, defaults := d.keyFiles()
+		for _, f := range files {
+			signer, err := d.loadKey(f)
+			if err != nil && defaults {
+				// the agent or another default key may still authenticate
+				d.log.Warn("skip the private key unable to be loaded", zap.String("key", f), zap.Error(err))
+				continue
+			}
+			if err != nil {
+				d.log.Error("unable to load private key", zap.String("key", f), zap.Error(err))
+				d.initErr = err
+				return
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) != 0 {
+			d.auth = append(d.auth, ssh.PublicKeys(signers...))
+		}
+		if len(d.auth) == 0 {
+			d.initErr = fmt.Errorf("no ssh key or agent to authenticate")
+			return
+		}
+
+		if d.config.InsecureIgnoreHostKey {
+			d.hostKeyCallback = ssh.InsecureIgnoreHostKey()
+			return
+		}
+		knownHosts := d.config.KnownHosts
+		if knownHosts == "" {
+			knownHosts = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+		}
+		d.hostKeyCallback, d.initErr = knownhosts.New(knownHosts)
+	})
+	return d.initErr
+}
+
+// Close closes the connection of the agent, the dialer is not used after it.
+func (d *Dialer) Close() error {
+	if d.agentConn == nil {
+		return nil
+	}
+	err := d.agentConn.Close()
+	d.agentConn = nil
+	return err
+}
+
+// jumps returns the hops to the host, HostJumps overrides Jump.
+func (d *Dialer) jumps(addr string) []string {
+	jumps, ok := d.config.HostJumps[addr]
+	if !ok {
+		jumps = d.config.Jump
+	}
+	if len(jumps) == 1 && jumps[0] == "none" {
+		return nil
+	}
+	return jumps
+}
+
+// parseJump parses a hop of [user@]host[:port], the user and the port
+// default to the ones of the target host.
+func (d *Dialer) parseJump(jump string, user string) (string, string, error) {
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		user, jump = jump[:i], jump[i+1:]
+	}
+	host, port, err := net.SplitHostPort(jump)
 	if err != nil {
-		log.Error("unable to parse private key", zap.Error(err))
-		return nil, err
+		host = strings.Trim(jump, "[]")
+		port = strconv.Itoa(d.port(host))
 	}
+	if host == "" || user == "" {
+		return "", "", fmt.Errorf("invalid jump host %s", jump)
+	}
+	return net.JoinHostPort(host, port), user, nil
+}
+
+// dialVia connects to the address through the client of the previous hop,
+// or directly if via is nil. The previous hop is closed with the new client.
+func (d *Dialer) dialVia(via *ssh.Client, hostport string, user string) (*ssh.Client, error) {
 	config := &ssh.ClientConfig{
 		User:            user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: d.hostKeyCallback,
+		Auth:            d.auth,
+	}
+	if via == nil {
+		return ssh.Dial("tcp", hostport, config)
 	}
 
-	client, err := ssh.Dial("tcp", net.JoinHostPort(addr, "22"), config)
+	conn, err := via.Dial("tcp", hostport)
 	if err != nil {
-		log.Error("unable to connect host", zap.Error(err), zap.String("host", addr), zap.String("user", user))
 		return nil, err
 	}
-
-	session, err := client.NewSession()
+	c, chans, reqs, err := ssh.NewClientConn(conn, hostport, config)
 	if err != nil {
-		log.Error("new session failed", zap.Error(err))
+		conn.Close()
 		return nil, err
 	}
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		via.Close()
+	}()
+	return client, nil
+}
+
+func (d *Dialer) Dial(addr string, user string) (*ssh.Client, error) {
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+
+	type hop struct{ hostport, user string }
+	var hops []hop
+	for _, jump := range d.jumps(addr) {
+		hostport, jumpUser, err := d.parseJump(jump, user)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop{hostport, jumpUser})
+	}
+	hops = append(hops, hop{net.JoinHostPort(addr, strconv.Itoa(d.port(addr))), user})
+
+	var client *ssh.Client
+	for _, h := range hops {
+		next, err := d.dialVia(client, h.hostport, h.user)
+		if err != nil {
+			d.log.Error("unable to connect host", zap.Error(err), zap.String("host", h.hostport),
+				zap.String("user", h.user), zap.String("target", addr))
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+		client = next
+	}
 
-	return session, nil
+	if d.config.ForwardAgent {
+		if err := agent.ForwardToRemote(client, os.Getenv("SSH_AUTH_SOCK")); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
-func ExecCommandBySSH(addr string, user string, cmd string, log *zap.Logger) error {
-	session, err := newSshSession(addr, user, log)
-	if err != nil {
-		return err
+// maxSessions is the sessions run at the same time on one connection,
+// sshd refuses the sessions more than MaxSessions, which is 10 by default.
+const maxSessions = 8
+
+type poolClient struct {
+	once     sync.Once
+	client   *ssh.Client
+	err      error
+	sessions chan struct{}
+}
+
+// Pool keeps one connection for every user@host and runs the commands
+// as sessions multiplexed over it, it is shared by a whole backup or restore.
+type Pool struct {
+	dialer  *Dialer
+	log     *zap.Logger
+	mutex   sync.Mutex
+	clients map[string]*poolClient
+}
+
+func NewPool(cf config.SSHConfig, log *zap.Logger) *Pool {
+	return &Pool{dialer: NewDialer(cf, log), log: log, clients: make(map[string]*poolClient)}
+}
+
+func (p *Pool) get(addr string, user string) *poolClient {
+	key := user + "@" + addr
+	p.mutex.Lock()
+	c, ok := p.clients[key]
+	if !ok {
+		c = &poolClient{sessions: make(chan struct{}, maxSessions)}
+		p.clients[key] = c
 	}
-	defer session.Close()
-	log.Info("ssh will exec", zap.String("cmd", cmd))
+	p.mutex.Unlock()
 
-	err = session.Run(cmd)
-	if err != nil {
-		log.Error("ssh run failed", zap.Error(err))
+	c.once.Do(func() {
+		c.client, c.err = p.dialer.Dial(addr, user)
+	})
+	return c
+}
+
+// remove drops a broken connection, so the next command dials again.
+func (p *Pool) remove(addr string, user string, c *poolClient) {
+	key := user + "@" + addr
+	p.mutex.Lock()
+	if p.clients[key] == c {
+		delete(p.clients, key)
+	}
+	p.mutex.Unlock()
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+// Close closes all the connections and the connection of the agent.
+func (p *Pool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var err error
+	for key, c := range p.clients {
+		if c.client != nil {
+			if e := c.client.Close(); e != nil {
+				err = e
+			}
+		}
+		delete(p.clients, key)
+	}
+	if e := p.dialer.Close(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// runSession runs f with a new session on the connection of the host,
+// it dials again once if the pooled connection is broken.
+func (p *Pool) runSession(ctx context.Context, addr string, user string, f func(*ssh.Session) error) error {
+	for retry := 0; ; retry++ {
+		c := p.get(addr, user)
+		if c.err != nil {
+			p.remove(addr, user, c)
+			return c.err
+		}
+
+		select {
+		case c.sessions <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		session, err := c.client.NewSession()
+		if err != nil {
+			<-c.sessions
+			if _, ok := err.(*ssh.OpenChannelError); !ok && retry == 0 {
+				p.log.Warn("ssh connection broken, reconnect", zap.String("host", addr), zap.Error(err))
+				p.remove(addr, user, c)
+				continue
+			}
+			p.log.Error("new session failed", zap.Error(err))
+			return err
+		}
+
+		if p.dialer.config.ForwardAgent {
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				session.Close()
+				<-c.sessions
+				return err
+			}
+		}
+
+		err = f(session)
+		session.Close()
+		<-c.sessions
 		return err
 	}
-	return nil
+}
+
+// ExecCommand runs the command on the host, the command is killed
+// when the context is done.
+func (p *Pool) ExecCommand(ctx context.Context, addr string, user string, cmd string) error {
+	return p.exec(ctx, addr, user, cmd, nil, "", false, nil)
+}
+
+// ExecCommandEnv runs the command with the environment, e.g. the credentials of the backend,
+// which is given as KEY=VALUE and never put on the command line.
+func (p *Pool) ExecCommandEnv(ctx context.Context, addr string, user string, cmd string, env []string) error {
+	return p.exec(ctx, addr, user, cmd, env, "", false, nil)
+}
+
+// ExecCommandOutput runs the command and returns its stdout.
+func (p *Pool) ExecCommandOutput(ctx context.Context, addr string, user string, cmd string) (string, error) {
+	var out bytes.Buffer
+	err := p.exec(ctx, addr, user, cmd, nil, "", false, &out)
+	return out.String(), err
+}
+
+// ExecSecretCommand runs a command which may carry a secret, e.g. a hook, with the environment
+// and returns its stdout. The command is replaced by REDACTED in the logs and in the CommandError.
+func (p *Pool) ExecSecretCommand(ctx context.Context, addr string, user string, cmd string, env []string) (string, error) {
+	var out bytes.Buffer
+	err := p.exec(ctx, addr, user, cmd, env, "", true, &out)
+	return out.String(), err
+}
+
+// lineWriter calls f with every line written to it, a line ends with \n or \r.
+type lineWriter struct {
+	buf []byte
+	f   func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			w.f(string(w.buf[:i]))
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) != 0 {
+		w.f(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// ExecCommandLines runs the command with the environment like ExecCommandEnv and calls f
+// with every line of its stdout as it is printed. The input is written to the stdin of the
+// command, e.g. a file list too long for the command line.
+func (p *Pool) ExecCommandLines(ctx context.Context, addr string, user string, cmd string, env []string, input string, f func(line string)) error {
+	w := &lineWriter{f: f}
+	err := p.exec(ctx, addr, user, cmd, env, input, false, w)
+	w.flush()
+	return err
+}
+
+// envCommand returns the command reading the values of the environment from stdin and
+// the stdin, so they are not seen by ps on the host or in the logs. Setenv is not used,
+// sshd only accepts the variables of its AcceptEnv.
+func envCommand(cmd string, env []string) (string, string) {
+	if len(env) == 0 {
+		return cmd, ""
+	}
+	var reads, names []string
+	var stdin strings.Builder
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		reads = append(reads, "IFS= read -r "+kv[:i])
+		names = append(names, kv[:i])
+		stdin.WriteString(kv[i+1:] + "\n")
+	}
+	return strings.Join(reads, " && ") + " && export " + strings.Join(names, " ") + " || exit 1; " + cmd, stdin.String()
+}
+
+// exec runs the command with the input as its stdin, the stdout is also written to out if it is not nil.
+// A secret command is not logged or kept in the CommandError.
+func (p *Pool) exec(ctx context.Context, addr string, user string, cmd string, env []string, input string, secret bool, out io.Writer) error {
+	shown := cmd
+	if secret {
+		shown = redact.Redacted
+	}
+	stdout, stderr := &tailBuffer{}, &tailBuffer{}
+	err := p.runSession(ctx, addr, user, func(session *ssh.Session) error {
+		p.log.Info("ssh will exec", zap.String("host", addr), zap.String("cmd", shown))
+
+		session.Stdout = stdout
+		if out != nil {
+			session.Stdout = io.MultiWriter(out, stdout)
+		}
+		session.Stderr = stderr
+		// the command reads the environment before the input
+		remote, stdin := envCommand(cmd, env)
+		if stdin += input; stdin != "" {
+			session.Stdin = strings.NewReader(stdin)
+		}
+		if err := session.Start(remote); err != nil {
+			return newCommandError(addr, user, shown, "", "", err)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- session.Wait() }()
+		select {
+		case err := <-done:
+			if err != nil {
+				return newCommandError(addr, user, shown, stdout.String(), stderr.String(), err)
+			}
+			return nil
+		case <-ctx.Done():
+			// the channel closed without a signal doesn't stop a command which doesn't
+			// read or write it, e.g. cp, so kill it before closing the session
+			p.log.Warn("ssh command canceled", zap.String("host", addr), zap.String("cmd", shown))
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+			<-done
+			return ctx.Err()
+		}
+	})
+	if e, ok := err.(*CommandError); ok {
+		p.log.Error("ssh run failed", zap.String("host", e.Host), zap.String("user", e.User),
+			zap.String("cmd", e.Command), zap.Int("exit", e.ExitCode),
+			zap.String("stdout", e.Stdout), zap.String("stderr", e.Stderr), zap.Error(e.Err))
+	}
+	return err
 }
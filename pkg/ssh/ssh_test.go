@@ -0,0 +1,561 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/monadbobo/br/pkg/config"
+)
+
+// testServer is a ssh server running the exec requests with sh -c.
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+	conns    int32
+	tunnels  int32
+	signals  int32
+}
+
+func newTestServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	cf.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: l, config: cf, hostKey: hostKey}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.conns, 1)
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() == "direct-tcpip" {
+			go s.tunnel(newChan)
+			continue
+		}
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, chReqs)
+	}
+}
+
+// session runs the exec request of a session channel, a signal request
+// or closing the channel kills the command.
+func (s *testServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	var cmd *exec.Cmd
+	done := make(chan struct{})
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				if cmd != nil {
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				}
+				return
+			}
+			switch {
+			case req.Type == "exec" && cmd == nil:
+				req.Reply(true, nil)
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+
+				cmd = exec.Command("sh", "-c", payload.Command)
+				cmd.Stdin = ch
+				cmd.Stdout = ch
+				cmd.Stderr = ch.Stderr()
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+				if err := cmd.Start(); err != nil {
+					return
+				}
+				go func() {
+					status := make([]byte, 4)
+					if err := cmd.Wait(); err != nil {
+						if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+							binary.BigEndian.PutUint32(status, uint32(exitErr.ExitCode()))
+						} else {
+							binary.BigEndian.PutUint32(status, 255)
+						}
+					}
+					ch.SendRequest("exit-status", false, status)
+					close(done)
+				}()
+			case req.Type == "signal" && cmd != nil:
+				atomic.AddInt32(&s.signals, 1)
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			default:
+				req.Reply(false, nil)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// tunnel forwards a direct-tcpip channel like a jump host.
+func (s *testServer) tunnel(newChan ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &payload); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.tunnels, 1)
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+}
+
+// newTestKey writes a new private key to dir and returns its public key.
+func newTestKey(t *testing.T, dir string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	keyFile := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, pub
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := newTestKey(t, dir)
+	server := newTestServer(t, pub)
+	defer server.close()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", server.port()))}, server.hostKey.PublicKey())
+	assert.NoError(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	cf := config.SSHConfig{
+		HostPorts:  map[string]int{"127.0.0.1": server.port()},
+		KeyFiles:   []string{keyFile},
+		KnownHosts: knownHostsFile,
+	}
+	p := NewPool(cf, log)
+	out, err := p.ExecCommandOutput(ctx, "127.0.0.1", "br", "echo hello")
+	assert.NoError(err)
+	assert.Equal("hello\n", out)
+
+	var lines []string
+	assert.NoError(p.ExecCommandLines(ctx, "127.0.0.1", "br", "printf 'a\\nb\\rc'", nil, "", func(line string) { lines = append(lines, line) }))
+	assert.Equal([]string{"a", "b", "c"}, lines)
+
+	// the environment is passed by stdin, not on the command line
+	lines = nil
+	env := []string{"AWS_ACCESS_KEY_ID=minio", "AWS_SECRET_ACCESS_KEY=it's a \\secret"}
+	assert.NoError(p.ExecCommandLines(ctx, "127.0.0.1", "br", `echo "$AWS_ACCESS_KEY_ID"; echo "$AWS_SECRET_ACCESS_KEY"`, env, "",
+		func(line string) { lines = append(lines, line) }))
+	assert.Equal([]string{"minio", "it's a \\secret"}, lines)
+
+	// the input follows the environment in stdin
+	lines = nil
+	assert.NoError(p.ExecCommandLines(ctx, "127.0.0.1", "br", `echo "$AWS_ACCESS_KEY_ID"; cat`, env, "data/1.sst\nwal/1.wal\n",
+		func(line string) { lines = append(lines, line) }))
+	assert.Equal([]string{"minio", "data/1.sst", "wal/1.wal"}, lines)
+	err = p.ExecCommandEnv(ctx, "127.0.0.1", "br", "echo $AWS_ACCESS_KEY_ID >&2; exit 2", env)
+	if cmdErr, ok := err.(*CommandError); assert.True(ok) {
+		assert.Equal("echo $AWS_ACCESS_KEY_ID >&2; exit 2", cmdErr.Command)
+		assert.Equal("minio\n", cmdErr.Stderr)
+	}
+
+	// a secret command is not kept in the error
+	out, err = p.ExecSecretCommand(ctx, "127.0.0.1", "br", "echo $BR_PHASE; echo Bearer SECRET123 >/dev/null; exit 4", []string{"BR_PHASE=upload"})
+	assert.Equal("upload\n", out)
+	if cmdErr, ok := err.(*CommandError); assert.True(ok) {
+		assert.Equal("REDACTED", cmdErr.Command)
+		assert.NotContains(err.Error(), "SECRET123")
+	}
+
+	err = p.ExecCommand(ctx, "127.0.0.1", "br", "echo out; echo oops >&2; exit 3")
+	cmdErr, ok := err.(*CommandError)
+	if assert.True(ok) {
+		assert.Equal("127.0.0.1", cmdErr.Host)
+		assert.Equal("br", cmdErr.User)
+		assert.Equal(3, cmdErr.ExitCode)
+		assert.Equal("out\n", cmdErr.Stdout)
+		assert.Equal("oops\n", cmdErr.Stderr)
+		assert.Contains(err.Error(), "exited with 3: oops")
+	}
+
+	// the output in the error is bounded
+	err = p.ExecCommand(ctx, "127.0.0.1", "br", "head -c 10000 /dev/zero | tr '\\0' x >&2; echo end >&2; exit 1")
+	if cmdErr, ok := err.(*CommandError); assert.True(ok) {
+		assert.Equal(len("...")+maxOutput, len(cmdErr.Stderr))
+		assert.True(strings.HasSuffix(cmdErr.Stderr, "xend\n"))
+	}
+
+	// more sessions than maxSessions share the connection
+	var wg sync.WaitGroup
+	for i := 0; i < maxSessions*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "sleep 0.1"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&server.conns))
+
+	// another user has its own connection
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "other", "true"))
+	assert.Equal(int32(2), atomic.LoadInt32(&server.conns))
+
+	// a closed connection is dialed again
+	assert.NoError(p.Close())
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	assert.Equal(int32(3), atomic.LoadInt32(&server.conns))
+	p.mutex.Lock()
+	for _, c := range p.clients {
+		c.client.Close()
+	}
+	p.mutex.Unlock()
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	assert.Equal(int32(4), atomic.LoadInt32(&server.conns))
+	assert.NoError(p.Close())
+}
+
+func TestHostKey(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := newTestKey(t, dir)
+	server := newTestServer(t, pub)
+	defer server.close()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", server.port()))}, server.hostKey.PublicKey())
+	assert.NoError(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	cf := config.SSHConfig{
+		HostPorts:  map[string]int{"127.0.0.1": server.port()},
+		KeyFiles:   []string{keyFile},
+		KnownHosts: knownHostsFile,
+	}
+	// the host key is not known
+	assert.NoError(ioutil.WriteFile(knownHostsFile, nil, 0600))
+	p := NewPool(cf, log)
+	assert.Error(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	p.Close()
+
+	cf.InsecureIgnoreHostKey = true
+	p = NewPool(cf, log)
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	p.Close()
+}
+
+func TestJump(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := newTestKey(t, dir)
+	bastion := newTestServer(t, pub)
+	defer bastion.close()
+	server := newTestServer(t, pub)
+	defer server.close()
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	var lines string
+	for _, s := range []*testServer{bastion, server} {
+		addr := knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", s.port()))
+		lines += knownhosts.Line([]string{addr}, s.hostKey.PublicKey()) + "\n"
+	}
+	assert.NoError(ioutil.WriteFile(knownHostsFile, []byte(lines), 0600))
+
+	bastionAddr := fmt.Sprintf("ops@127.0.0.1:%d", bastion.port())
+	cf := config.SSHConfig{
+		HostPorts:  map[string]int{"127.0.0.1": server.port()},
+		KeyFiles:   []string{keyFile},
+		KnownHosts: knownHostsFile,
+		Jump:       []string{bastionAddr},
+	}
+	p := NewPool(cf, log)
+	out, err := p.ExecCommandOutput(ctx, "127.0.0.1", "br", "echo hello")
+	assert.NoError(err)
+	assert.Equal("hello\n", out)
+	assert.Equal(int32(1), atomic.LoadInt32(&bastion.tunnels))
+	assert.Equal(int32(1), atomic.LoadInt32(&server.conns))
+	p.Close()
+
+	// two hops through the same bastion
+	cf.Jump = []string{bastionAddr, bastionAddr}
+	p = NewPool(cf, log)
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	assert.Equal(int32(3), atomic.LoadInt32(&bastion.tunnels))
+	p.Close()
+
+	// the host connects directly
+	cf.HostJumps = map[string][]string{"127.0.0.1": {"none"}}
+	p = NewPool(cf, log)
+	assert.NoError(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	assert.Equal(int32(3), atomic.LoadInt32(&bastion.tunnels))
+	p.Close()
+
+	// the jump host is not reachable
+	cf.HostJumps = nil
+	cf.Jump = []string{"127.0.0.1:1"}
+	p = NewPool(cf, log)
+	assert.Error(p.ExecCommand(ctx, "127.0.0.1", "br", "true"))
+	p.Close()
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := newTestKey(t, dir)
+	server := newTestServer(t, pub)
+	defer server.close()
+
+	cf := config.SSHConfig{
+		HostPorts:             map[string]int{"127.0.0.1": server.port()},
+		KeyFiles:              []string{keyFile},
+		InsecureIgnoreHostKey: true,
+	}
+	p := NewPool(cf, log)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	marker := filepath.Join(dir, "marker")
+	start := time.Now()
+	err = p.ExecCommand(ctx, "127.0.0.1", "br", "sleep 2; touch "+marker)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(int32(1), atomic.LoadInt32(&server.signals))
+
+	// the remote command is killed
+	time.Sleep(2500 * time.Millisecond)
+	_, err = os.Stat(marker)
+	assert.True(os.IsNotExist(err))
+
+	// the connection is still usable
+	assert.NoError(p.ExecCommand(context.Background(), "127.0.0.1", "br", "true"))
+	assert.Equal(int32(1), atomic.LoadInt32(&server.conns))
+}
+
+// setenv sets the environment variable and returns the func restoring it.
+func setenv(key string, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestDefaultKeys(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	home, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(home)
+	defer setenv("HOME", home)()
+	defer setenv("BR_SSH_PASSPHRASE", "")()
+
+	dir := filepath.Join(home, ".ssh")
+	assert.NoError(os.MkdirAll(dir, 0700))
+	keyFile, pub := newTestKey(t, dir)
+	server := newTestServer(t, pub)
+	defer server.close()
+
+	// an encrypted key without a passphrase and a broken key are skipped
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "id_ecdsa"), pem.EncodeToMemory(block), 0600))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "id_ed25519"), []byte("broken"), 0600))
+
+	cf := config.SSHConfig{
+		HostPorts:             map[string]int{"127.0.0.1": server.port()},
+		InsecureIgnoreHostKey: true,
+	}
+	p := NewPool(cf, log)
+	assert.NoError(p.ExecCommand(context.Background(), "127.0.0.1", "br", "true"))
+	p.Close()
+
+	// but the keys given by --key are not
+	cf.KeyFiles = []string{keyFile, filepath.Join(dir, "id_ed25519")}
+	p = NewPool(cf, log)
+	assert.Error(p.ExecCommand(context.Background(), "127.0.0.1", "br", "true"))
+	p.Close()
+
+	// no key at all
+	assert.NoError(os.Remove(keyFile))
+	cf.KeyFiles = nil
+	p = NewPool(cf, log)
+	assert.Error(p.ExecCommand(context.Background(), "127.0.0.1", "br", "true"))
+	p.Close()
+}
+
+func TestForwardAgentConn(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-ssh")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	keyFile, _ := newTestKey(t, dir)
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	assert.NoError(err)
+	defer l.Close()
+	defer setenv("SSH_AUTH_SOCK", sock)()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(agent.NewKeyring(), conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	wait := func() bool {
+		select {
+		case <-closed:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	// the agent only checked for the forwarding is closed at once
+	d := NewDialer(config.SSHConfig{ForwardAgent: true, KeyFiles: []string{keyFile}, InsecureIgnoreHostKey: true}, log)
+	assert.NoError(d.init())
+	assert.True(wait())
+
+	// the agent authenticating is closed with the dialer
+	d = NewDialer(config.SSHConfig{UseAgent: true, InsecureIgnoreHostKey: true}, log)
+	assert.NoError(d.init())
+	assert.False(wait())
+	assert.NoError(d.Close())
+	assert.True(wait())
+}
@@ -2,18 +2,23 @@ package storage
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"go.uber.org/zap"
 )
 
 type LocalBackedStore struct {
+	root       string
 	dir        string
 	backupName string
 	log        *zap.Logger
 }
 
 func NewLocalBackedStore(dir string, log *zap.Logger) *LocalBackedStore {
-	return &LocalBackedStore{dir: dir, log: log}
+	return &LocalBackedStore{root: dir, dir: dir, log: log}
 }
 
 func (s *LocalBackedStore) SetBackupName(name string) {
@@ -26,7 +31,7 @@ func (s LocalBackedStore) URI() string {
 }
 
 func (s LocalBackedStore) copyCommand(src []string, dir string) string {
-	cmdFormat := "mkdir -p " + dir + " && cp -rf %s " + dir
+	cmdFormat := "mkdir -p " + dir + " && cp -rfv %s " + dir
 	files := ""
 	for _, f := range src {
 		files += f + " "
@@ -35,6 +40,10 @@ func (s LocalBackedStore) copyCommand(src []string, dir string) string {
 	return fmt.Sprintf(cmdFormat, files)
 }
 
+func (s LocalBackedStore) Env() []string {
+	return nil
+}
+
 func (s *LocalBackedStore) BackupPreCommand() []string {
 	return []string{"mkdir", s.dir}
 }
@@ -48,13 +57,22 @@ func (s LocalBackedStore) BackupStorageCommand(src string, host string, spaceId
 	storageDir := s.dir + "/" + "storage/" + host + "/" + spaceId
 	data := src + "/data "
 	wal := src + "/wal "
-	return "mkdir -p " + storageDir + " && cp -rf " + data + wal + storageDir
+	return "mkdir -p " + storageDir + " && cp -rfv " + data + wal + storageDir
+}
+
+func (s LocalBackedStore) BackupStorageFilesCommand(src string, host string, spaceId string) string {
+	storageDir := s.dir + "/" + "storage/" + host + "/" + spaceId
+	return "mkdir -p " + storageDir + " && cd " + src + " && " + xargs + " cp --parents -fvt " + storageDir
 }
 
 func (s LocalBackedStore) BackupMetaFileCommand(src string) []string {
 	return []string{"cp", src, s.dir}
 }
 
+func (s LocalBackedStore) ReportFileCommand(src string, name string) []string {
+	return []string{"install", "-D", "-m", "644", src, s.root + "/" + ReportDir + "/" + name}
+}
+
 func (s LocalBackedStore) RestoreMetaFileCommand(file string, dst string) []string {
 	return []string{"cp", s.dir + "/" + file, dst}
 }
@@ -65,7 +83,7 @@ func (s LocalBackedStore) RestoreMetaCommand(src []string, dst string) string {
 	for _, f := range src {
 		files += metaDir + f + " "
 	}
-	return fmt.Sprintf("cp -rf %s "+dst, files)
+	return fmt.Sprintf("cp -rfv %s "+dst, files)
 }
 
 func (s LocalBackedStore) RestoreStorageCommand(host string, spaceID []string, dst string) string {
@@ -75,5 +93,58 @@ func (s LocalBackedStore) RestoreStorageCommand(host string, spaceID []string, d
 		dirs += storageDir + id + " "
 	}
 
-	return fmt.Sprintf("cp -rf %s "+dst, dirs)
+	return fmt.Sprintf("cp -rfv %s "+dst, dirs)
+}
+
+func (s LocalBackedStore) RestoreStorageFilesCommand(backupName string, host string, spaceID string, dst string) string {
+	storageDir := s.root + "/" + backupName + "/storage/" + host + "/" + spaceID
+	return "mkdir -p " + dst + "/" + spaceID + " && cd " + storageDir + " && " + xargs + " cp --parents -fvt " + dst + "/" + spaceID
+}
+
+func (s LocalBackedStore) ListObjects(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.Walk(filepath.Join(s.root, prefix), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (s LocalBackedStore) Open(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.root, path))
+}
+
+func (s LocalBackedStore) Remove(prefix string) error {
+	return os.RemoveAll(filepath.Join(s.root, prefix))
+}
+
+func (s LocalBackedStore) CheckWriteCommand(host string) string {
+	f := s.root + "/.br_check_" + host
+	return "mkdir -p " + s.root + " && touch " + f + " && rm -f " + f
+}
+
+func (s LocalBackedStore) FreeSpaceCommand() string {
+	return "df -Pk " + s.root + " | tail -1 | awk '{print $4}'"
+}
+
+// CopiedFile parses a line of cp -v, 'src' -> 'dst'.
+func (s LocalBackedStore) CopiedFile(line string) (string, string, bool) {
+	i := strings.Index(line, " -> ")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.Trim(line[:i], "'"), strings.Trim(line[i+len(" -> "):], "'"), true
 }
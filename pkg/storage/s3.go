@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// S3Options carries the connection settings of an S3 compatible backend.
+// Empty fields are left to the aws cli defaults of the host running the command.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// parseS3Options reads the options from the query of a s3:// url,
+// e.g. s3://bucket/prefix?endpoint=http://127.0.0.1:9000&region=us-east-1,
+// credentials fall back to the AWS_* environment variables of br.
+func parseS3Options(q url.Values) S3Options {
+	opts := S3Options{
+		Endpoint:  q.Get("endpoint"),
+		Region:    q.Get("region"),
+		AccessKey: q.Get("access_key"),
+		SecretKey: q.Get("secret_key"),
+	}
+	if opts.AccessKey == "" {
+		opts.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if opts.SecretKey == "" {
+		opts.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if opts.Region == "" {
+		opts.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return opts
+}
+
+// S3BackedStore uploads and downloads the backup with the aws cli,
+// which must be installed on the meta and storage hosts.
+type S3BackedStore struct {
+	bucket     string
+	root       string
+	prefix     string
+	backupName string
+	opts       S3Options
+	log        *zap.Logger
+}
+
+func NewS3BackedStore(bucket string, prefix string, opts S3Options, log *zap.Logger) *S3BackedStore {
+	prefix = strings.Trim(prefix, "/")
+	return &S3BackedStore{bucket: bucket, root: prefix, prefix: prefix, opts: opts, log: log}
+}
+
+func (s *S3BackedStore) SetBackupName(name string) {
+	s.backupName = name
+	s.prefix = path.Join(s.prefix, name)
+}
+
+func (s S3BackedStore) URI() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+func (s S3BackedStore) uri(elem ...string) string {
+	return "s3://" + path.Join(append([]string{s.bucket, s.prefix}, elem...)...)
+}
+
+// Env returns the credentials, they are never put on the command lines seen by ps and the logs.
+func (s S3BackedStore) Env() []string {
+	var env []string
+	if s.opts.AccessKey != "" {
+		env = append(env, "AWS_ACCESS_KEY_ID="+s.opts.AccessKey)
+	}
+	if s.opts.SecretKey != "" {
+		env = append(env, "AWS_SECRET_ACCESS_KEY="+s.opts.SecretKey)
+	}
+	return env
+}
+
+// command returns the aws cli run by br itself with the credentials.
+func (s S3BackedStore) command(args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), s.Env()...)
+	return cmd
+}
+
+// awsArgs returns the aws cli invocation with the global options.
+func (s S3BackedStore) awsArgs() []string {
+	args := []string{"aws"}
+	if s.opts.Endpoint != "" {
+		args = append(args, "--endpoint-url", s.opts.Endpoint)
+	}
+	if s.opts.Region != "" {
+		args = append(args, "--region", s.opts.Region)
+	}
+	return args
+}
+
+func (s S3BackedStore) aws() string {
+	return strings.Join(s.awsArgs(), " ")
+}
+
+func (s S3BackedStore) copyCommand(src string, dst string, recursive bool) string {
+	if recursive {
+		return fmt.Sprintf("%s s3 cp --recursive %s %s", s.aws(), src, dst)
+	}
+	return fmt.Sprintf("%s s3 cp %s %s", s.aws(), src, dst)
+}
+
+func (s *S3BackedStore) BackupPreCommand() []string {
+	return append(s.awsArgs(), "s3api", "head-bucket", "--bucket", s.bucket)
+}
+
+func (s S3BackedStore) BackupMetaCommand(src []string) string {
+	var cmds []string
+	for _, f := range src {
+		cmds = append(cmds, s.copyCommand(f, s.uri("meta", path.Base(f)), false))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func (s S3BackedStore) BackupStorageCommand(src string, host string, spaceId string) string {
+	data := s.copyCommand(src+"/data", s.uri("storage", host, spaceId, "data"), true)
+	wal := s.copyCommand(src+"/wal", s.uri("storage", host, spaceId, "wal"), true)
+	return data + " && " + wal
+}
+
+// includeFiles returns the command copying the files read from stdin, they are turned into
+// the filters of aws s3 cp, which is run more than once if they are too many for a command line.
+func (s S3BackedStore) includeFiles(src string, dst string) string {
+	return "sed 's/^/--include=/' | " + xargs + " " + s.copyCommand(src, dst, true) + " --exclude '*'"
+}
+
+func (s S3BackedStore) BackupStorageFilesCommand(src string, host string, spaceId string) string {
+	return s.includeFiles(src, s.uri("storage", host, spaceId))
+}
+
+func (s S3BackedStore) BackupMetaFileCommand(src string) []string {
+	return append(s.awsArgs(), "s3", "cp", src, s.uri(path.Base(src)))
+}
+
+func (s S3BackedStore) ReportFileCommand(src string, name string) []string {
+	return append(s.awsArgs(), "s3", "cp", src, "s3://"+path.Join(s.bucket, s.root, ReportDir, name))
+}
+
+func (s S3BackedStore) RestoreMetaFileCommand(file string, dst string) []string {
+	return append(s.awsArgs(), "s3", "cp", s.uri(file), dst)
+}
+
+func (s S3BackedStore) RestoreMetaCommand(src []string, dst string) string {
+	var cmds []string
+	for _, f := range src {
+		cmds = append(cmds, s.copyCommand(s.uri("meta", f), dst+"/", false))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func (s S3BackedStore) RestoreStorageCommand(host string, spaceID []string, dst string) string {
+	var cmds []string
+	for _, id := range spaceID {
+		cmds = append(cmds, s.copyCommand(s.uri("storage", host, id), dst+"/"+id, true))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func (s S3BackedStore) RestoreStorageFilesCommand(backupName string, host string, spaceID string, dst string) string {
+	src := "s3://" + path.Join(s.bucket, s.root, backupName, "storage", host, spaceID)
+	return s.includeFiles(src, dst+"/"+spaceID)
+}
+
+// the output of aws s3 ls --recursive: 2020-11-10 10:00:00       1234 prefix/name/file
+var s3LsLine = regexp.MustCompile(`^(\S+ \S+)\s+(\d+) (.+)$`)
+
+func (s S3BackedStore) ListObjects(prefix string) ([]ObjectInfo, error) {
+	root := path.Join(s.bucket, s.root)
+	cmd := s.command(append(s.awsArgs(), "s3", "ls", "--recursive", "s3://"+path.Join(root, prefix)+"/"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// aws s3 ls exits with 1 when nothing matches
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && stderr.Len() == 0 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%v: %s", err, stderr.String())
+	}
+
+	var objects []ObjectInfo
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		m := s3LsLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		modTime, err := time.ParseInLocation("2006-01-02 15:04:05", m[1], time.Local)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		key := m[3]
+		if s.root != "" {
+			key = strings.TrimPrefix(key, s.root+"/")
+		}
+		objects = append(objects, ObjectInfo{Path: key, Size: size, ModTime: modTime})
+	}
+	return objects, scanner.Err()
+}
+
+type s3Reader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *s3Reader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+func (s S3BackedStore) Open(file string) (io.ReadCloser, error) {
+	cmd := s.command(append(s.awsArgs(), "s3", "cp", "s3://"+path.Join(s.bucket, s.root, file), "-"))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &s3Reader{ReadCloser: out, cmd: cmd}, nil
+}
+
+func (s S3BackedStore) Remove(prefix string) error {
+	out, err := s.command(append(s.awsArgs(), "s3", "rm", "--recursive", "s3://"+path.Join(s.bucket, s.root, prefix)+"/")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func (s S3BackedStore) CheckWriteCommand(host string) string {
+	uri := "s3://" + path.Join(s.bucket, s.root, ".br_check_"+host)
+	return "echo br | " + s.copyCommand("-", uri, false) + " && " + s.aws() + " s3 rm " + uri
+}
+
+func (s S3BackedStore) FreeSpaceCommand() string {
+	return ""
+}
+
+// CopiedFile parses a line of aws s3 cp, upload: src to dst or download: src to dst.
+func (s S3BackedStore) CopiedFile(line string) (string, string, bool) {
+	for _, prefix := range []string{"upload: ", "download: "} {
+		if strings.HasPrefix(line, prefix) {
+			if i := strings.Index(line, " to "); i > 0 {
+				return line[len(prefix):i], line[i+len(" to "):], true
+			}
+		}
+	}
+	return "", "", false
+}
@@ -2,21 +2,56 @@ package storage
 
 import (
 	"fmt"
+	"io"
 	"net/url"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// ObjectInfo is a file in the backend storage, Path is relative to the root of the backend.
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ExternalStorage generates the commands run on the meta and storage hosts to
+// move the backup in and out of the backend, the List and Open methods are
+// run by br itself.
 type ExternalStorage interface {
 	SetBackupName(name string)
 	BackupPreCommand() []string
 	BackupStorageCommand(src string, host string, spaceID string) string
+	// BackupStorageFilesCommand only uploads the files given in its stdin by FileList, they are relative to src.
+	BackupStorageFilesCommand(src string, host string, spaceID string) string
 	BackupMetaCommand(src []string) string
 	BackupMetaFileCommand(src string) []string
+	// ReportFileCommand uploads a local file as ReportDir/name under the backend root.
+	ReportFileCommand(src string, name string) []string
 	RestoreMetaFileCommand(file string, dst string) []string
 	RestoreMetaCommand(src []string, dst string) string
 	RestoreStorageCommand(host string, spaceID []string, dst string) string
+	// RestoreStorageFilesCommand downloads the files of a space given in its stdin by FileList
+	// from another backup into dst/spaceID.
+	RestoreStorageFilesCommand(backupName string, host string, spaceID string, dst string) string
 	URI() string
+	// ListObjects lists all the files under prefix recursively, the prefix is relative to the backend root.
+	ListObjects(prefix string) ([]ObjectInfo, error)
+	// Open opens a file of the backend, the path is relative to the backend root.
+	Open(path string) (io.ReadCloser, error)
+	// Remove removes all the files under prefix, the prefix is relative to the backend root.
+	Remove(prefix string) error
+	// CheckWriteCommand writes and removes a file named after the host in the backend root.
+	CheckWriteCommand(host string) string
+	// FreeSpaceCommand prints the free kilobytes of the backend root, empty if it is not a local disk.
+	FreeSpaceCommand() string
+	// Env is the environment the commands need as KEY=VALUE, e.g. the credentials of the backend,
+	// they are passed to the commands out of the command lines.
+	Env() []string
+	// CopiedFile returns the source and the destination of the file copied from a line of the output of the commands.
+	CopiedFile(line string) (src string, dst string, ok bool)
 }
 
 func NewExternalStorage(storageUrl string, log *zap.Logger) (ExternalStorage, error) {
@@ -30,7 +65,28 @@ func NewExternalStorage(storageUrl string, log *zap.Logger) (ExternalStorage, er
 	switch u.Scheme {
 	case "local":
 		return NewLocalBackedStore(u.Path, log), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("Missing bucket in s3 url: %s", storageUrl)
+		}
+		return NewS3BackedStore(u.Host, u.Path, parseS3Options(u.Query()), log), nil
 	default:
 		return nil, fmt.Errorf("Unsupported Backend Storage Types")
 	}
 }
+
+// ReportDir is the dir under the backend root keeping the reports of the failed backups,
+// whose backup dirs are removed.
+const ReportDir = "reports"
+
+// xargs runs the command with the lines of stdin as its arguments, more than once if they
+// are too many for a command line, and not at all if there is none.
+const xargs = "xargs -r -d '\\n'"
+
+// FileList is the stdin of the Files commands.
+func FileList(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	return strings.Join(files, "\n") + "\n"
+}
@@ -1,8 +1,15 @@
 package storage
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -17,3 +24,297 @@ func TestStorage(t *testing.T) {
 
 	assert.Equal(s.URI(), "/tmp/backup")
 }
+
+func TestS3Storage(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	s, err := NewExternalStorage("s3://br-test/backup?endpoint=http://127.0.0.1:9000&region=us-east-1&access_key=minio&secret_key=minio123", logger)
+	assert.NoError(err)
+	assert.Equal(reflect.TypeOf(s).String(), "*storage.S3BackedStore")
+	assert.Equal(s.URI(), "s3://br-test/backup")
+
+	// the credentials are not on the command lines
+	assert.Equal([]string{"AWS_ACCESS_KEY_ID=minio", "AWS_SECRET_ACCESS_KEY=minio123"}, s.Env())
+	aws := "aws --endpoint-url http://127.0.0.1:9000 --region us-east-1"
+	assert.Equal(strings.Join(s.BackupPreCommand(), " "), aws+" s3api head-bucket --bucket br-test")
+
+	s.SetBackupName("BACKUP_2020_11_10")
+	assert.Equal(s.URI(), "s3://br-test/backup/BACKUP_2020_11_10")
+
+	assert.Equal(s.BackupStorageCommand("/data/cp", "192.168.8.1", "1"),
+		aws+" s3 cp --recursive /data/cp/data s3://br-test/backup/BACKUP_2020_11_10/storage/192.168.8.1/1/data && "+
+			aws+" s3 cp --recursive /data/cp/wal s3://br-test/backup/BACKUP_2020_11_10/storage/192.168.8.1/1/wal")
+	assert.Equal(s.BackupMetaCommand([]string{"/meta/a.sst", "/meta/b.sst"}),
+		aws+" s3 cp /meta/a.sst s3://br-test/backup/BACKUP_2020_11_10/meta/a.sst && "+
+			aws+" s3 cp /meta/b.sst s3://br-test/backup/BACKUP_2020_11_10/meta/b.sst")
+	assert.Equal(strings.Join(s.BackupMetaFileCommand("/tmp/BACKUP_2020_11_10.meta"), " "),
+		aws+" s3 cp /tmp/BACKUP_2020_11_10.meta s3://br-test/backup/BACKUP_2020_11_10/BACKUP_2020_11_10.meta")
+	assert.Equal(strings.Join(s.ReportFileCommand("/tmp/report.json", "BACKUP_2020_11_10.json"), " "),
+		aws+" s3 cp /tmp/report.json s3://br-test/backup/reports/BACKUP_2020_11_10.json")
+	assert.Equal(strings.Join(s.RestoreMetaFileCommand("BACKUP_2020_11_10.meta", "/tmp/"), " "),
+		aws+" s3 cp s3://br-test/backup/BACKUP_2020_11_10/BACKUP_2020_11_10.meta /tmp/")
+	assert.Equal(s.RestoreStorageCommand("192.168.8.1", []string{"1", "2"}, "/data/storage"),
+		aws+" s3 cp --recursive s3://br-test/backup/BACKUP_2020_11_10/storage/192.168.8.1/1 /data/storage/1 && "+
+			aws+" s3 cp --recursive s3://br-test/backup/BACKUP_2020_11_10/storage/192.168.8.1/2 /data/storage/2")
+	assert.Equal(s.CheckWriteCommand("192.168.8.1"),
+		"echo br | "+aws+" s3 cp - s3://br-test/backup/.br_check_192.168.8.1 && "+
+			aws+" s3 rm s3://br-test/backup/.br_check_192.168.8.1")
+	assert.Empty(s.FreeSpaceCommand())
+	assert.Equal(s.BackupStorageFilesCommand("/data/cp", "192.168.8.1", "1"),
+		"sed 's/^/--include=/' | xargs -r -d '\\n' "+aws+" s3 cp --recursive /data/cp s3://br-test/backup/BACKUP_2020_11_10/storage/192.168.8.1/1 --exclude '*'")
+	assert.Equal(s.RestoreStorageFilesCommand("BACKUP_1", "192.168.8.1", "1", "/data/storage"),
+		"sed 's/^/--include=/' | xargs -r -d '\\n' "+aws+" s3 cp --recursive s3://br-test/backup/BACKUP_1/storage/192.168.8.1/1 /data/storage/1 --exclude '*'")
+
+	_, err = NewExternalStorage("s3:///backup", logger)
+	assert.Error(err)
+}
+
+func TestLocalListObjects(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	dir, err := ioutil.TempDir("", "br")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "BACKUP_1", "meta"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "BACKUP_1", "meta", "a.sst"), []byte("abc"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "BACKUP_1", "BACKUP_1.meta"), []byte("m"), 0644))
+
+	s, err := NewExternalStorage("local://"+dir, logger)
+	assert.NoError(err)
+	objects, err := s.ListObjects("")
+	assert.NoError(err)
+	assert.Len(objects, 2)
+	assert.Equal("BACKUP_1/BACKUP_1.meta", objects[0].Path)
+	assert.Equal("BACKUP_1/meta/a.sst", objects[1].Path)
+	assert.Equal(int64(3), objects[1].Size)
+
+	objects, err = s.ListObjects("BACKUP_2")
+	assert.NoError(err)
+	assert.Len(objects, 0)
+
+	r, err := s.Open("BACKUP_1/meta/a.sst")
+	assert.NoError(err)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.NoError(err)
+	assert.Equal("abc", string(data))
+}
+
+func TestLocalStorageFiles(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	dir, err := ioutil.TempDir("", "br-storage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewExternalStorage("local://"+dir+"/backup", logger)
+	assert.NoError(err)
+	s.SetBackupName("BACKUP_2")
+
+	// the files are given in stdin, not on the command line
+	files := []string{"data/MANIFEST-000001", "wal/1/0001.wal"}
+	for _, f := range append(files, "data/000012.sst") {
+		assert.NoError(os.MkdirAll(filepath.Dir(dir+"/cp/"+f), 0755))
+		assert.NoError(ioutil.WriteFile(dir+"/cp/"+f, []byte(f), 0644))
+	}
+	cmd := exec.Command("sh", "-c", s.BackupStorageFilesCommand(dir+"/cp", "192.168.8.1", "1"))
+	cmd.Stdin = strings.NewReader(FileList(files))
+	assert.NoError(cmd.Run())
+	objects, err := s.ListObjects("BACKUP_2")
+	assert.NoError(err)
+	if assert.Len(objects, 2) {
+		assert.Equal("BACKUP_2/storage/192.168.8.1/1/data/MANIFEST-000001", objects[0].Path)
+		assert.Equal("BACKUP_2/storage/192.168.8.1/1/wal/1/0001.wal", objects[1].Path)
+	}
+
+	// nothing is copied without a file
+	assert.NoError(exec.Command("sh", "-c", s.BackupStorageFilesCommand(dir+"/cp", "192.168.8.2", "1")).Run())
+	objects, err = s.ListObjects("BACKUP_2/storage/192.168.8.2")
+	assert.NoError(err)
+	assert.Empty(objects)
+
+	cmd = exec.Command("sh", "-c", s.RestoreStorageFilesCommand("BACKUP_2", "192.168.8.1", "1", dir+"/storage"))
+	cmd.Stdin = strings.NewReader(FileList(files[1:]))
+	assert.NoError(cmd.Run())
+	data, err := ioutil.ReadFile(dir + "/storage/1/wal/1/0001.wal")
+	assert.NoError(err)
+	assert.Equal("wal/1/0001.wal", string(data))
+	_, err = os.Stat(dir + "/storage/1/data/MANIFEST-000001")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestLocalCheckCommands(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	dir, err := ioutil.TempDir("", "br-storage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewExternalStorage("local://"+dir+"/backup", logger)
+	assert.NoError(err)
+	assert.NoError(exec.Command("sh", "-c", s.CheckWriteCommand("192.168.8.1")).Run())
+	entries, err := ioutil.ReadDir(dir + "/backup")
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	out, err := exec.Command("sh", "-c", s.FreeSpaceCommand()).Output()
+	assert.NoError(err)
+	_, err = strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	assert.NoError(err)
+}
+
+func TestCopiedFile(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	dir, err := ioutil.TempDir("", "br-storage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	local, err := NewExternalStorage("local://"+dir+"/backup", logger)
+	assert.NoError(err)
+	assert.NoError(os.MkdirAll(dir+"/cp/data", 0755))
+	assert.NoError(ioutil.WriteFile(dir+"/cp/data/000012.sst", nil, 0644))
+	out, err := exec.Command("sh", "-c", local.BackupMetaCommand([]string{dir + "/cp/data/000012.sst"})).Output()
+	assert.NoError(err)
+	src, dst, ok := local.CopiedFile(strings.TrimSpace(string(out)))
+	assert.True(ok)
+	assert.Equal(dir+"/cp/data/000012.sst", src)
+	assert.Equal(dir+"/backup/meta/000012.sst", dst)
+	_, _, ok = local.CopiedFile("mkdir: created directory 'meta'")
+	assert.False(ok)
+
+	s3, err := NewExternalStorage("s3://br-test/backup", logger)
+	assert.NoError(err)
+	src, dst, ok = s3.CopiedFile("upload: /data/cp/data/000012.sst to s3://br-test/backup/storage/192.168.8.1/1/data/000012.sst")
+	assert.True(ok)
+	assert.Equal("/data/cp/data/000012.sst", src)
+	assert.Equal("s3://br-test/backup/storage/192.168.8.1/1/data/000012.sst", dst)
+	_, dst, ok = s3.CopiedFile("download: s3://br-test/backup/storage/192.168.8.1/1/data/000012.sst to /data/storage/1/data/000012.sst")
+	assert.True(ok)
+	assert.Equal("/data/storage/1/data/000012.sst", dst)
+	_, _, ok = s3.CopiedFile("Completed 1.0 MiB/2.0 MiB (1.0 MiB/s) with 1 file(s) remaining")
+	assert.False(ok)
+}
+
+// fakeAws is an aws cli keeping the buckets as the dirs of $FAKE_S3, it logs
+// the access key and the arguments of every call to $FAKE_S3/aws.log.
+const fakeAws = `#!/bin/sh
+echo "$AWS_ACCESS_KEY_ID $*" >> "$FAKE_S3/aws.log"
+while [ "${1#--}" != "$1" ]; do shift 2; done
+url=
+for a in "$@"; do
+	case "$a" in s3://*) url=${a#s3://}; break;; esac
+done
+bucket=${url%%/*}
+if [ ! -d "$FAKE_S3/$bucket" ]; then
+	echo "An error occurred (NoSuchBucket) when calling the ListObjectsV2 operation" >&2
+	exit 1
+fi
+case "$2" in
+ls)
+	[ -e "$FAKE_S3/$url" ] || exit 1
+	cd "$FAKE_S3/$bucket" && find "./${url#$bucket}" -type f | sort | while read -r f; do
+		f=$(echo "$f" | sed 's|^\.//*||')
+		printf '2020-11-10 10:00:00 %10d %s\n' "$(wc -c < "$f")" "$f"
+	done;;
+cp)
+	cat "$FAKE_S3/$url";;
+rm)
+	rm -rf "$FAKE_S3/$url" && echo "delete: s3://$url";;
+esac
+`
+
+func setenv(key string, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestS3Objects(t *testing.T) {
+	assert := assert.New(t)
+	logger, _ := zap.NewProduction()
+	dir, err := ioutil.TempDir("", "br-storage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.Mkdir(dir+"/bin", 0755))
+	assert.NoError(ioutil.WriteFile(dir+"/bin/aws", []byte(fakeAws), 0755))
+	defer setenv("PATH", dir+"/bin:"+os.Getenv("PATH"))()
+	defer setenv("FAKE_S3", dir)()
+	for _, f := range []string{"a/b/BACKUP_1/BACKUP_1.meta", "a/b/BACKUP_1/storage/192.168.8.1/1/data/000010.sst", "a/bc/BACKUP_2/BACKUP_2.meta", "README"} {
+		assert.NoError(os.MkdirAll(filepath.Dir(dir+"/br-test/"+f), 0755))
+		assert.NoError(ioutil.WriteFile(dir+"/br-test/"+f, []byte(f), 0644))
+	}
+
+	// the keys are relative to the nested root, the dirs sharing its prefix are not in it
+	s, err := NewExternalStorage("s3://br-test/a/b/?region=us-east-1&access_key=minio&secret_key=minio123", logger)
+	assert.NoError(err)
+	objects, err := s.ListObjects("")
+	assert.NoError(err)
+	modTime := time.Date(2020, 11, 10, 10, 0, 0, 0, time.Local)
+	assert.Equal([]ObjectInfo{
+		{Path: "BACKUP_1/BACKUP_1.meta", Size: 26, ModTime: modTime},
+		{Path: "BACKUP_1/storage/192.168.8.1/1/data/000010.sst", Size: 50, ModTime: modTime},
+	}, objects)
+	objects, err = s.ListObjects("BACKUP_1/storage")
+	assert.NoError(err)
+	assert.Len(objects, 1)
+
+	// aws s3 ls exits with 1 and prints nothing when nothing matches
+	objects, err = s.ListObjects("BACKUP_2")
+	assert.NoError(err)
+	assert.Empty(objects)
+
+	// an empty root lists the whole bucket
+	all, err := NewExternalStorage("s3://br-test", logger)
+	assert.NoError(err)
+	objects, err = all.ListObjects("")
+	assert.NoError(err)
+	var paths []string
+	for _, o := range objects {
+		paths = append(paths, o.Path)
+	}
+	assert.Equal([]string{"README", "a/b/BACKUP_1/BACKUP_1.meta", "a/b/BACKUP_1/storage/192.168.8.1/1/data/000010.sst", "a/bc/BACKUP_2/BACKUP_2.meta"}, paths)
+
+	r, err := s.Open("BACKUP_1/BACKUP_1.meta")
+	assert.NoError(err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.NoError(r.Close())
+	assert.Equal("a/b/BACKUP_1/BACKUP_1.meta", string(data))
+	r, err = s.Open("BACKUP_2/BACKUP_2.meta")
+	assert.NoError(err)
+	ioutil.ReadAll(r)
+	assert.Error(r.Close())
+
+	assert.NoError(s.Remove("BACKUP_1"))
+	objects, err = s.ListObjects("")
+	assert.NoError(err)
+	assert.Empty(objects)
+	_, err = os.Stat(dir + "/br-test/a/bc/BACKUP_2/BACKUP_2.meta")
+	assert.NoError(err)
+
+	// an error printed by aws is not taken as nothing matches
+	missing, err := NewExternalStorage("s3://br-missing/backup", logger)
+	assert.NoError(err)
+	_, err = missing.ListObjects("")
+	assert.Error(err)
+	assert.Contains(err.Error(), "NoSuchBucket")
+	assert.Error(missing.Remove("BACKUP_1"))
+
+	// the credentials are given in the environment, not the arguments
+	log, err := ioutil.ReadFile(dir + "/aws.log")
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	assert.Equal("minio --region us-east-1 s3 ls --recursive s3://br-test/a/b/", lines[0])
+	assert.Equal("minio --region us-east-1 s3 cp s3://br-test/a/b/BACKUP_1/BACKUP_1.meta -", lines[4])
+	assert.Equal("minio --region us-east-1 s3 rm --recursive s3://br-test/a/b/BACKUP_1/", lines[6])
+	assert.NotContains(string(log), "minio123")
+}
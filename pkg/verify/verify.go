@@ -0,0 +1,215 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/storage"
+)
+
+// Problem is a file of the backup which is missing or corrupt.
+type Problem struct {
+	Path   string
+	Reason string
+}
+
+func (p Problem) String() string {
+	return p.Path + ": " + p.Reason
+}
+
+// Result is the outcome of a verification.
+type Result struct {
+	Checked  int
+	Problems []Problem
+}
+
+func (r *Result) addProblem(file string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Path: file, Reason: fmt.Sprintf(format, args...)})
+}
+
+type Verify struct {
+	config  config.VerifyConfig
+	backend storage.ExternalStorage
+	log     *zap.Logger
+	// the files of the backups, backup name -> path -> object
+	objects map[string]map[string]storage.ObjectInfo
+}
+
+func NewVerify(cf config.VerifyConfig, log *zap.Logger) (*Verify, error) {
+	backend, err := storage.NewExternalStorage(cf.BackendUrl, log)
+	if err != nil {
+		return nil, err
+	}
+	return &Verify{config: cf, backend: backend, log: log, objects: make(map[string]map[string]storage.ObjectInfo)}, nil
+}
+
+func (v *Verify) backupObjects(name string) (map[string]storage.ObjectInfo, error) {
+	if objects, ok := v.objects[name]; ok {
+		return objects, nil
+	}
+
+	list, err := v.backend.ListObjects(name)
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]storage.ObjectInfo)
+	for _, o := range list {
+		objects[o.Path] = o
+	}
+	v.objects[name] = objects
+	return objects, nil
+}
+
+func (v *Verify) checksum(file string) (string, error) {
+	r, err := v.backend.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkFile checks the file of the backup exists with the recorded size and checksum.
+func (v *Verify) checkFile(result *Result, backupName string, file string, record *manifest.File) error {
+	objects, err := v.backupObjects(backupName)
+	if err != nil {
+		return err
+	}
+
+	result.Checked++
+	o, ok := objects[file]
+	if !ok {
+		result.addProblem(file, "missing")
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+	if o.Size != record.Size {
+		result.addProblem(file, "size mismatch, expected %d, got %d", record.Size, o.Size)
+		return nil
+	}
+	if record.SHA256 == "" {
+		return nil
+	}
+
+	sum, err := v.checksum(file)
+	if err != nil {
+		return err
+	}
+	if sum != record.SHA256 {
+		result.addProblem(file, "checksum mismatch, expected %s, got %s", record.SHA256, sum)
+	}
+	return nil
+}
+
+// checkDir checks there are files under the dir, used for the backups without a manifest.
+func (v *Verify) checkDir(result *Result, backupName string, dir string) error {
+	objects, err := v.backupObjects(backupName)
+	if err != nil {
+		return err
+	}
+
+	result.Checked++
+	for p := range objects {
+		if len(p) > len(dir) && p[:len(dir)+1] == dir+"/" {
+			return nil
+		}
+	}
+	result.addProblem(dir, "missing")
+	return nil
+}
+
+// VerifyBackup checks every meta file and every checkpoint file of every
+// storage host recorded for the backup exists and is not corrupt.
+func (v *Verify) VerifyBackup() (*Result, error) {
+	name := v.config.BackupName
+	result := &Result{}
+
+	objects, err := v.backupObjects(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := objects[path.Join(name, metafile.Name(name))]; !ok {
+		result.addProblem(path.Join(name, metafile.Name(name)), "missing, the backup is not complete")
+		return result, nil
+	}
+
+	m, err := metafile.Load(v.backend, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var man *manifest.Manifest
+	if _, ok := objects[path.Join(name, manifest.Name(name))]; ok {
+		man, err = manifest.Load(v.backend, name)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		v.log.Warn("backup has no manifest, only check the files exist", zap.String("backup", name))
+	}
+
+	metaRecords := make(map[string]*manifest.File)
+	if man != nil {
+		for i := range man.MetaFiles {
+			metaRecords[man.MetaFiles[i].Path] = &man.MetaFiles[i]
+		}
+	}
+	for _, f := range m.GetMetaFiles() {
+		err := v.checkFile(result, name, path.Join(name, "meta", f), metaRecords[f])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for id, info := range m.GetBackupInfo() {
+		spaceID := strconv.FormatInt(int64(id), 10)
+		for _, cp := range info.GetCpDirs() {
+			host := cp.GetHost().GetHost()
+			var files *manifest.StorageFiles
+			if man != nil {
+				files = man.Find(host, spaceID)
+			}
+			if files == nil {
+				if man != nil {
+					result.addProblem(path.Join(name, "storage", host, spaceID), "not in the manifest")
+				}
+				if err := v.checkDir(result, name, path.Join(name, "storage", host, spaceID)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			for i := range files.Files {
+				f := &files.Files[i]
+				backupName := name
+				if f.Backup != "" {
+					backupName = f.Backup
+				}
+				err := v.checkFile(result, backupName, path.Join(backupName, "storage", host, spaceID, f.Path), f)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sort.Slice(result.Problems, func(i, j int) bool { return result.Problems[i].Path < result.Problems[j].Path })
+	return result, nil
+}
@@ -0,0 +1,139 @@
+package verify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/monadbobo/br/pkg/config"
+	"github.com/monadbobo/br/pkg/manifest"
+	"github.com/monadbobo/br/pkg/metafile"
+	"github.com/monadbobo/br/pkg/nebula"
+	"github.com/monadbobo/br/pkg/nebula/meta"
+)
+
+// writeBackup writes a backup of space 1 on 192.168.8.1 into dir, the storage files
+// reused from the base backup are not written.
+func writeBackup(t *testing.T, dir string, name string, base string, metaFiles map[string]string, storageFiles map[string]string, reused []string) {
+	write := func(file string, content string) manifest.File {
+		p := filepath.Join(dir, name, file)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(content))
+		return manifest.File{Path: filepath.Base(file), Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+	}
+
+	m := &manifest.Manifest{Version: manifest.Version, BackupName: name, BaseBackup: base}
+	bm := &meta.BackupMeta{BackupName: name, BackupInfo: map[nebula.GraphSpaceID]*meta.SpaceBackupInfo{
+		1: {
+			Space:         &meta.SpaceDesc{SpaceName: []byte("nba"), VidType: meta.NewColumnTypeDef()},
+			PartitionInfo: &nebula.PartitionBackupInfo{},
+			CpDirs:        []*meta.CheckpointInfo{{Host: &nebula.HostAddr{Host: "192.168.8.1", Port: 44500}, CheckpointDir: []byte("/data/cp")}},
+		},
+	}}
+	for f, content := range metaFiles {
+		m.MetaFiles = append(m.MetaFiles, write("meta/"+f, content))
+		bm.MetaFiles = append(bm.MetaFiles, f)
+	}
+	sf := &manifest.StorageFiles{Host: "192.168.8.1", SpaceID: "1"}
+	for f, content := range storageFiles {
+		file := write("storage/192.168.8.1/1/"+f, content)
+		file.Path = f
+		sf.Files = append(sf.Files, file)
+	}
+	for _, f := range reused {
+		content := storageFiles[f]
+		if content == "" {
+			t.Fatalf("the content of the reused file %s is not given", f)
+		}
+		// the reused file is recorded, but it is in the base backup
+		os.Remove(filepath.Join(dir, name, "storage/192.168.8.1/1", f))
+		for i := range sf.Files {
+			if sf.Files[i].Path == f {
+				sf.Files[i].Backup = base
+			}
+		}
+	}
+	m.Storage = []*manifest.StorageFiles{sf}
+
+	file, err := os.Create(filepath.Join(dir, name, manifest.Name(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := manifest.Write(file, m); err != nil {
+		t.Fatal(err)
+	}
+	metaFile, err := os.Create(filepath.Join(dir, name, metafile.Name(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaFile.Close()
+	if err := metafile.Write(metaFile, bm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	assert := assert.New(t)
+	log, _ := zap.NewDevelopment()
+	dir, err := ioutil.TempDir("", "br-verify")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	base, incr := "BACKUP_2020_11_10_10_00_00", "BACKUP_2020_11_11_10_00_00"
+	writeBackup(t, dir, base, "", map[string]string{"1.sst": "meta"},
+		map[string]string{"data/000010.sst": "sst10", "wal/1.wal": "wal"}, nil)
+	writeBackup(t, dir, incr, base, map[string]string{"1.sst": "meta2"},
+		map[string]string{"data/000010.sst": "sst10", "data/000012.sst": "sst12", "wal/1.wal": "wal2"}, []string{"data/000010.sst"})
+
+	verify := func() []Problem {
+		v, err := NewVerify(config.VerifyConfig{BackendUrl: "local://" + dir, BackupName: incr}, log)
+		assert.NoError(err)
+		result, err := v.VerifyBackup()
+		assert.NoError(err)
+		assert.Equal(4, result.Checked)
+		return result.Problems
+	}
+	assert.Empty(verify())
+
+	storage := func(backup string, file string) string {
+		return filepath.Join(dir, backup, "storage/192.168.8.1/1", file)
+	}
+
+	// a file of the base backup reused is corrupt
+	assert.NoError(ioutil.WriteFile(storage(base, "data/000010.sst"), []byte("sst1x"), 0644))
+	problems := verify()
+	if assert.Len(problems, 1) {
+		assert.Equal(base+"/storage/192.168.8.1/1/data/000010.sst", problems[0].Path)
+		assert.Contains(problems[0].Reason, "checksum mismatch")
+	}
+
+	// a file of the backup is missing, another has another size
+	assert.NoError(os.Remove(storage(base, "data/000010.sst")))
+	assert.NoError(os.Remove(storage(incr, "data/000012.sst")))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, incr, "meta/1.sst"), []byte("meta22"), 0644))
+	assert.Equal([]Problem{
+		{Path: base + "/storage/192.168.8.1/1/data/000010.sst", Reason: "missing"},
+		{Path: incr + "/meta/1.sst", Reason: "size mismatch, expected 5, got 6"},
+		{Path: incr + "/storage/192.168.8.1/1/data/000012.sst", Reason: "missing"},
+	}, verify())
+
+	// an incomplete backup
+	assert.NoError(os.Remove(filepath.Join(dir, incr, metafile.Name(incr))))
+	v, err := NewVerify(config.VerifyConfig{BackendUrl: "local://" + dir, BackupName: incr}, log)
+	assert.NoError(err)
+	result, err := v.VerifyBackup()
+	assert.NoError(err)
+	assert.Equal([]Problem{{Path: incr + "/" + metafile.Name(incr), Reason: "missing, the backup is not complete"}}, result.Problems)
+}
@@ -0,0 +1,4 @@
+package version
+
+// Version is the version of br, it is recorded in the backup manifest too.
+var Version string = "2.0"